@@ -0,0 +1,37 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileReplacesContent(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "credentials")
+
+	require.Nil(t, os.WriteFile(filename, []byte("old"), 0644))
+	require.Nil(t, WriteFile(filename, []byte("new"), 0600))
+
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+
+	info, err := os.Stat(filename)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// no temp file is left behind
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestWriteFileMissingDirectory(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "missing", "credentials")
+
+	assert.NotNil(t, WriteFile(filename, []byte("new"), 0600))
+}
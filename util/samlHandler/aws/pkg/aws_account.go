@@ -6,6 +6,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gocloak/util/samlHandler/aws/pkg/prompter"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/pkg/errors"
@@ -19,7 +24,12 @@ type AWSAccount struct {
 
 // ParseAWSAccounts extract the aws accounts from the saml assertion
 func ParseAWSAccounts(audience string, samlAssertion string) ([]*AWSAccount, error) {
-	res, err := http.PostForm(audience, url.Values{"SAMLResponse": {samlAssertion}})
+	return ParseAWSAccountsWithClient(http.DefaultClient, audience, samlAssertion)
+}
+
+// ParseAWSAccountsWithClient extract the aws accounts from the saml assertion, posting it with client
+func ParseAWSAccountsWithClient(client *http.Client, audience string, samlAssertion string) ([]*AWSAccount, error) {
+	res, err := client.PostForm(audience, url.Values{"SAMLResponse": {samlAssertion}})
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving AWS login form")
 	}
@@ -72,7 +82,7 @@ func AssignPrincipals(awsRoles []*AWSRole, awsAccounts []*AWSAccount) {
 
 }
 
-// LocateRole locate role by name
+// LocateRole locate role by name, either the full RoleARN or a unique suffix of it such as the role name
 func LocateRole(awsRoles []*AWSRole, roleName string) (*AWSRole, error) {
 	for _, awsRole := range awsRoles {
 		if awsRole.RoleARN == roleName {
@@ -80,5 +90,175 @@ func LocateRole(awsRoles []*AWSRole, roleName string) (*AWSRole, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("Supplied RoleArn not found in saml assertion: %s", roleName)
+	candidates := []*AWSRole{}
+	for _, awsRole := range awsRoles {
+		if strings.HasSuffix(awsRole.RoleARN, "/"+roleName) || strings.HasSuffix(awsRole.RoleARN, ":"+roleName) {
+			candidates = append(candidates, awsRole)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("Supplied RoleArn not found in saml assertion: %s", roleName)
+	case 1:
+		return candidates[0], nil
+	}
+
+	candidateARNs := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidateARNs = append(candidateARNs, "  "+candidate.RoleARN)
+	}
+
+	return nil, fmt.Errorf("Supplied RoleArn %s is ambiguous, matching roles:\n%s", roleName, strings.Join(candidateARNs, "\n"))
+}
+
+// FilterRoles keep only the roles accepted by the keep func
+func FilterRoles(awsRoles []*AWSRole, keep func(*AWSRole) bool) []*AWSRole {
+	filtered := []*AWSRole{}
+	for _, awsRole := range awsRoles {
+		if keep(awsRole) {
+			filtered = append(filtered, awsRole)
+		}
+	}
+
+	return filtered
+}
+
+// FilterAccounts keep only the account roles accepted by the keep func, accounts left without roles are dropped
+func FilterAccounts(awsAccounts []*AWSAccount, keep func(*AWSRole) bool) []*AWSAccount {
+	filtered := []*AWSAccount{}
+	for _, awsAccount := range awsAccounts {
+		roles := FilterRoles(awsAccount.Roles, keep)
+		if len(roles) == 0 {
+			continue
+		}
+		filtered = append(filtered, &AWSAccount{Name: awsAccount.Name, Roles: roles})
+	}
+
+	return filtered
+}
+
+// AccountRoles flatten the roles of the accounts, in the order they are listed
+func AccountRoles(awsAccounts []*AWSAccount) []*AWSRole {
+	awsRoles := []*AWSRole{}
+	for _, awsAccount := range awsAccounts {
+		awsRoles = append(awsRoles, awsAccount.Roles...)
+	}
+
+	return awsRoles
+}
+
+// LocateRoleByIndex locate role by its 1-based position in the list
+func LocateRoleByIndex(awsRoles []*AWSRole, index int) (*AWSRole, error) {
+	if index >= 1 && index <= len(awsRoles) {
+		return awsRoles[index-1], nil
+	}
+
+	available := make([]string, 0, len(awsRoles))
+	for i, awsRole := range awsRoles {
+		available = append(available, fmt.Sprintf("  %d: %s", i+1, awsRole.RoleARN))
+	}
+
+	return nil, fmt.Errorf("Supplied role index %d out of range 1-%d, available roles:\n%s", index, len(awsRoles), strings.Join(available, "\n"))
+}
+
+// accountNamePattern the account names of the AWS sign-in page, "Account: <alias> (<account id>)"
+var accountNamePattern = regexp.MustCompile(`^Account: (.*) \((\d{12})\)$`)
+
+// AccountAlias returns the alias and account ID of an account name as shown on the AWS sign-in page, the
+// alias is the account ID itself when the account has none
+func AccountAlias(name string) (alias string, accountID string) {
+	matches := accountNamePattern.FindStringSubmatch(strings.TrimSpace(name))
+	if matches == nil {
+		return strings.TrimSpace(name), ""
+	}
+
+	return matches[1], matches[2]
+}
+
+// LocateRoleByAccountAndName locate the role named roleName in the account accountAlias, as in "prod / Admin".
+// The account matches on its alias, its account ID or its full name, the role on its name.
+func LocateRoleByAccountAndName(awsAccounts []*AWSAccount, accountAlias, roleName string) (*AWSRole, error) {
+	candidates := []*AWSRole{}
+	for _, awsAccount := range awsAccounts {
+		alias, accountID := AccountAlias(awsAccount.Name)
+		if accountAlias != alias && accountAlias != accountID && accountAlias != awsAccount.Name {
+			continue
+		}
+
+		for _, awsRole := range awsAccount.Roles {
+			if awsRole.Name == roleName || strings.HasSuffix(awsRole.RoleARN, "/"+roleName) {
+				candidates = append(candidates, awsRole)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("Role %s not found in account %s", roleName, accountAlias)
+	case 1:
+		return candidates[0], nil
+	}
+
+	candidateARNs := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidateARNs = append(candidateARNs, "  "+candidate.RoleARN)
+	}
+
+	return nil, fmt.Errorf("Role %s of account %s is ambiguous, matching roles:\n%s", roleName, accountAlias, strings.Join(candidateARNs, "\n"))
+}
+
+// SortAccounts sorts the accounts by name and the roles of every account by name
+func SortAccounts(awsAccounts []*AWSAccount) {
+	sort.SliceStable(awsAccounts, func(i, j int) bool {
+		return awsAccounts[i].Name < awsAccounts[j].Name
+	})
+	for _, awsAccount := range awsAccounts {
+		sort.SliceStable(awsAccount.Roles, func(i, j int) bool {
+			return awsAccount.Roles[i].Name < awsAccount.Roles[j].Name
+		})
+	}
+}
+
+// PromptForAWSRoleSelection asks the user to pick one of the roles of the accounts. The account names are
+// padded to line the role names up in a column, typing filters the options.
+func PromptForAWSRoleSelection(accounts []*AWSAccount) (*AWSRole, error) {
+	return promptForAWSRoleSelection(accounts, prompter.ChooseWithDefault)
+}
+
+// PromptForAWSRoleSelectionFuzzy is PromptForAWSRoleSelection narrowing the roles down with a fuzzy match of what
+// is typed, e.g. "prdadm" for the Admin role of prod
+func PromptForAWSRoleSelectionFuzzy(accounts []*AWSAccount) (*AWSRole, error) {
+	return promptForAWSRoleSelection(accounts, prompter.ChooseFuzzy)
+}
+
+func promptForAWSRoleSelection(accounts []*AWSAccount, choose func(string, string, []string) (string, error)) (*AWSRole, error) {
+	roles := map[string]*AWSRole{}
+	var roleOptions []string
+
+	width := 0
+	for _, account := range accounts {
+		if len(account.Name) > width {
+			width = len(account.Name)
+		}
+	}
+
+	for _, account := range accounts {
+		for _, role := range account.Roles {
+			name := fmt.Sprintf("%-*s  %s", width, account.Name, role.Name)
+			roles[name] = role
+			roleOptions = append(roleOptions, name)
+		}
+	}
+
+	if len(roleOptions) == 0 {
+		return nil, errors.New("no roles to choose from")
+	}
+
+	selectedRole, err := choose("Please choose the role", roleOptions[0], roleOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Role selection failed")
+	}
+
+	return roles[selectedRole], nil
 }
@@ -58,3 +58,29 @@ func parseRole(role string) (*AWSRole, error) {
 
 	return awsRole, nil
 }
+
+// ExtractAccountID returns the account ID of an ARN, or an empty string if it isn't a valid ARN
+func ExtractAccountID(arn string) string {
+	tokens := strings.SplitN(arn, ":", 6)
+	if len(tokens) != 6 || tokens[0] != "arn" {
+		return ""
+	}
+
+	return tokens[4]
+}
+
+// ExtractSessionName returns the session name of an assumed role ARN, the part after assumed-role/<role>/,
+// or an empty string if it isn't an assumed role ARN
+func ExtractSessionName(arn string) string {
+	tokens := strings.SplitN(arn, ":", 6)
+	if len(tokens) != 6 || tokens[0] != "arn" {
+		return ""
+	}
+
+	resource := strings.SplitN(tokens[5], "/", 3)
+	if len(resource) != 3 || resource[0] != "assumed-role" {
+		return ""
+	}
+
+	return resource[2]
+}
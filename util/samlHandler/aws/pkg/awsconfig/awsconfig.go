@@ -1,12 +1,15 @@
 package awsconfig
 
 import (
+	"bytes"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"time"
 
+	"gocloak/util/samlHandler/aws/pkg/atomicfile"
+
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -34,6 +37,40 @@ type AWSCredentials struct {
 	Region           string    `ini:"region,omitempty"`
 }
 
+// IsExpiring whether the credentials expire within the given duration, credentials without a known
+// expiry are treated as expiring so they get refreshed
+func (c *AWSCredentials) IsExpiring(within time.Duration) bool {
+	return c.IsExpiringAt(time.Now(), within)
+}
+
+// IsExpiringAt whether the credentials expire within the given duration of now, see IsExpiring
+func (c *AWSCredentials) IsExpiringAt(now time.Time, within time.Duration) bool {
+	if c == nil || c.Expires.IsZero() {
+		return true
+	}
+
+	return c.Expires.Sub(now) <= within
+}
+
+// TTL how long the credentials remain valid, zero once expired or when the expiry isn't known
+func (c *AWSCredentials) TTL() time.Duration {
+	return c.TTLAt(time.Now())
+}
+
+// TTLAt how long the credentials remain valid from now, see TTL
+func (c *AWSCredentials) TTLAt(now time.Time) time.Duration {
+	if c == nil || c.Expires.IsZero() {
+		return 0
+	}
+
+	ttl := c.Expires.Sub(now)
+	if ttl < 0 {
+		return 0
+	}
+
+	return ttl
+}
+
 // CredentialsProvider loads aws credentials file
 type CredentialsProvider struct {
 	Filename string
@@ -246,5 +283,12 @@ func saveProfile(filename, profile string, awsCreds *AWSCredentials) error {
 		return err
 	}
 
-	return config.SaveTo(filename)
+	var buf bytes.Buffer
+	_, err = config.WriteTo(&buf)
+	if err != nil {
+		return err
+	}
+
+	// never leave a half written credentials file for the aws cli to choke on
+	return atomicfile.WriteFile(filename, buf.Bytes(), 0600)
 }
@@ -63,6 +63,7 @@ type IDPAccount struct {
 	BrowserDriverDir      string `ini:"browser_driver_dir,omitempty"` // used by browser; hide from user if not set
 	Headless              bool   `ini:"headless"`                     // used by browser
 	Prompter              string `ini:"prompter"`
+	CookieJarFile         string `ini:"cookie_jar_file"` // persists the IdP session cookies between logins
 }
 
 func (ia IDPAccount) String() string {
@@ -228,6 +229,25 @@ func (cm *ConfigManager) LoadIDPAccount(idpAccountName string) (*IDPAccount, err
 	return account, nil
 }
 
+// IDPAccountNames the names of the idp accounts stored in the configuration file
+func (cm *ConfigManager) IDPAccountNames() ([]string, error) {
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true, SpaceBeforeInlineComment: true}, cm.configPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to load configuration file")
+	}
+
+	names := []string{}
+	for _, name := range cfg.SectionStrings() {
+		if name == ini.DefaultSection {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
 func readAccount(idpAccountName string, cfg *ini.File) (*IDPAccount, error) {
 
 	account := NewIDPAccount()
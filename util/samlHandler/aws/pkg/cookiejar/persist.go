@@ -0,0 +1,78 @@
+package cookiejar
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gocloak/util/samlHandler/aws/pkg/atomicfile"
+)
+
+// Save writes the unexpired cookies of the jar, session cookies included, to filename as JSON.
+// The file is only readable by its owner as it holds live session cookies.
+func (j *Jar) Save(filename string) error {
+	j.mu.Lock()
+	now := time.Now()
+	entries := make(map[string]map[string]entry)
+	for key, submap := range j.entries {
+		for id, e := range submap {
+			if !e.Expires.After(now) {
+				continue
+			}
+			if entries[key] == nil {
+				entries[key] = make(map[string]entry)
+			}
+			entries[key][id] = e
+		}
+	}
+	j.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+
+	return atomicfile.WriteFile(filename, data, 0600)
+}
+
+// Load merges the unexpired cookies previously written by Save into the jar.
+// A missing file is not an error, the jar is simply left as is.
+func (j *Jar) Load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	entries := make(map[string]map[string]entry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for key, submap := range entries {
+		for id, e := range submap {
+			if !e.Expires.After(now) {
+				continue
+			}
+			if j.entries[key] == nil {
+				j.entries[key] = make(map[string]entry)
+			}
+			e.seqNum = j.nextSeqNum
+			j.nextSeqNum++
+			j.entries[key][id] = e
+		}
+	}
+
+	return nil
+}
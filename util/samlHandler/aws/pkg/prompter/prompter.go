@@ -3,6 +3,9 @@ package prompter
 import (
 	"fmt"
 	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ActivePrompter is by default the survey cli prompter
@@ -18,6 +21,11 @@ type Prompter interface {
 	Password(string) string
 }
 
+// FuzzyChooser is implemented by the prompters able to filter the options with a fuzzy match as the user types
+type FuzzyChooser interface {
+	ChooseFuzzy(string, string, []string) (string, error)
+}
+
 // SetPrompter configure an aternate prompter to the default one
 func SetPrompter(prmpt Prompter) {
 	ActivePrompter = prmpt
@@ -60,6 +68,40 @@ func ChooseWithDefault(pr string, defaultValue string, options []string) (string
 	return ActivePrompter.ChooseWithDefault(pr, defaultValue, options)
 }
 
+// ChooseFuzzy given the choice return the option selected with a default, narrowing the options down with a fuzzy
+// match of what is typed. Prompters which can't filter fall back to ChooseWithDefault.
+func ChooseFuzzy(pr string, defaultValue string, options []string) (string, error) {
+	fuzzy, ok := ActivePrompter.(FuzzyChooser)
+	if !ok {
+		return ChooseWithDefault(pr, defaultValue, options)
+	}
+
+	if defaultValue == "" && len(options) > 0 {
+		defaultValue = options[0]
+	}
+
+	return fuzzy.ChooseFuzzy(pr, defaultValue, options)
+}
+
+// FuzzyMatch whether the characters of filter appear in value in the same order, ignoring case and spaces,
+// so "prdadm" matches "prod  Admin"
+func FuzzyMatch(filter, value string) bool {
+	value = strings.ToLower(value)
+	for _, r := range strings.ToLower(filter) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+
+		i := strings.IndexRune(value, r)
+		if i < 0 {
+			return false
+		}
+		value = value[i+utf8.RuneLen(r):]
+	}
+
+	return true
+}
+
 // Choose given the choice return the option selected
 func Choose(pr string, options []string) int {
 	return ActivePrompter.Choose(pr, options)
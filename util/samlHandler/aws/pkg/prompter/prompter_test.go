@@ -0,0 +1,26 @@
+package prompter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	assert.True(t, FuzzyMatch("", "prod  Admin"))
+	assert.True(t, FuzzyMatch("prdadm", "prod  Admin"))
+	assert.True(t, FuzzyMatch("PROD adm", "prod  Admin"))
+	assert.False(t, FuzzyMatch("admprd", "prod  Admin"))
+	assert.False(t, FuzzyMatch("staging", "prod  Admin"))
+}
+
+func TestChooseFuzzyFallsBackToChooseWithDefault(t *testing.T) {
+	previous := ActivePrompter
+	t.Cleanup(func() { SetPrompter(previous) })
+
+	fake := &FakeDefaultPrompter{}
+	SetPrompter(fake)
+
+	_, _ = ChooseFuzzy("Please choose the role", "", []string{"a", "b"})
+	assert.True(t, fake.CalledChooseWithDefault)
+}
@@ -45,6 +45,35 @@ func (cli *CliPrompter) ChooseWithDefault(pr string, defaultValue string, option
 	return "", errors.New("bad input")
 }
 
+// fuzzyPageSize how many options the fuzzy prompt shows at once
+const fuzzyPageSize = 15
+
+// ChooseFuzzy given the choice return the option selected with a default, filtering the options with FuzzyMatch
+func (cli *CliPrompter) ChooseFuzzy(pr string, defaultValue string, options []string) (string, error) {
+	selected := ""
+	prompt := &survey.Select{
+		Message:  pr,
+		Options:  options,
+		Default:  defaultValue,
+		PageSize: fuzzyPageSize,
+	}
+	err := survey.AskOne(prompt, &selected,
+		survey.WithValidator(survey.Required),
+		survey.WithFilter(func(filter string, value string, index int) bool {
+			return FuzzyMatch(filter, value)
+		}))
+	if err != nil {
+		return "", err
+	}
+
+	for i, option := range options {
+		if selected == option {
+			return options[i], nil
+		}
+	}
+	return "", errors.New("bad input")
+}
+
 // Choose given the choice return the option selected
 func (cli *CliPrompter) Choose(pr string, options []string) int {
 	selected := ""
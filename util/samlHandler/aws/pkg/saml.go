@@ -3,16 +3,21 @@ package saml2aws
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/beevik/etree"
 )
 
 const (
+	principalTagAttributePrefix = "https://aws.amazon.com/SAML/Attributes/PrincipalTag:"
+	transitiveTagKeysAttribute  = "https://aws.amazon.com/SAML/Attributes/TransitiveTagKeys"
+
 	assertionTag          = "Assertion"
 	attributeStatementTag = "AttributeStatement"
 	attributeTag          = "Attribute"
 	attributeValueTag     = "AttributeValue"
+	issuerTag             = "Issuer"
 	responseTag           = "Response"
 )
 
@@ -73,6 +78,110 @@ func ExtractSessionDuration(data []byte) (int64, error) {
 	return 0, nil
 }
 
+// ExtractSessionTags this will extract the session tags, keyed by tag name, from the PrincipalTag attributes
+// of the assertion, see https://docs.aws.amazon.com/IAM/latest/UserGuide/id_session-tags.html#id_session-tags_adding-assume-role-saml
+func ExtractSessionTags(data []byte) (map[string]string, error) {
+	tags := map[string]string{}
+
+	attributes, err := assertionAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attribute := range attributes {
+		name := attribute.SelectAttrValue("Name", "")
+		if !strings.HasPrefix(name, principalTagAttributePrefix) {
+			continue
+		}
+		for _, attrValue := range attribute.FindElements(childPath(attribute.Space, attributeValueTag)) {
+			tags[strings.TrimPrefix(name, principalTagAttributePrefix)] = attrValue.Text()
+		}
+	}
+
+	return tags, nil
+}
+
+// ExtractTransitiveTagKeys this will extract the session tags marked transitive by the assertion, these are kept
+// when the role is chained. AssumeRoleWithSAML takes them from the assertion only.
+func ExtractTransitiveTagKeys(data []byte) ([]string, error) {
+	keys := []string{}
+
+	attributes, err := assertionAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attribute := range attributes {
+		if attribute.SelectAttrValue("Name", "") != transitiveTagKeysAttribute {
+			continue
+		}
+		for _, attrValue := range attribute.FindElements(childPath(attribute.Space, attributeValueTag)) {
+			keys = append(keys, attrValue.Text())
+		}
+	}
+
+	return keys, nil
+}
+
+// HasAwsRoleAttribute whether the assertion carries the AWS Role attribute, with or without values
+func HasAwsRoleAttribute(data []byte) (bool, error) {
+	attributes, err := assertionAttributes(data)
+	if err != nil {
+		return false, err
+	}
+
+	for _, attribute := range attributes {
+		if attribute.SelectAttrValue("Name", "") == "https://aws.amazon.com/SAML/Attributes/Role" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ExtractIssuer returns the issuer of the SAML response, or else of its assertion
+func ExtractIssuer(data []byte) (string, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return "", err
+	}
+
+	rootElement := doc.Root()
+	if rootElement == nil {
+		return "", ErrMissingElement{Tag: responseTag}
+	}
+
+	issuerElement := rootElement.FindElement(childPath(rootElement.Space, issuerTag))
+	if issuerElement == nil {
+		issuerElement = doc.FindElement(".//" + issuerTag)
+	}
+	if issuerElement == nil {
+		return "", ErrMissingElement{Tag: issuerTag}
+	}
+
+	return strings.TrimSpace(issuerElement.Text()), nil
+}
+
+// assertionAttributes returns the Attribute elements of the assertion
+func assertionAttributes(data []byte) ([]*etree.Element, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, err
+	}
+
+	assertionElement := doc.FindElement(".//Assertion")
+	if assertionElement == nil {
+		return nil, ErrMissingAssertion
+	}
+
+	attributeStatement := assertionElement.FindElement(childPath(assertionElement.Space, attributeStatementTag))
+	if attributeStatement == nil {
+		return nil, ErrMissingElement{Tag: attributeStatementTag}
+	}
+
+	return attributeStatement.FindElements(childPath(assertionElement.Space, attributeTag)), nil
+}
+
 // ExtractDestinationURL will find the Destination URL to POST the SAML assertion to.
 // This is necessary to support AWS instances with custom endpoints such as GovCloud and AWS China without requiring
 // hardcoded endpoints on the saml2aws side.
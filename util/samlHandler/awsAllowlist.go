@@ -0,0 +1,78 @@
+package samllogin
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+
+	"github.com/pkg/errors"
+)
+
+// loadRoleAllowlist reads the role ARNs permitted by the allowlist file, one per line. Blank lines and lines
+// starting with # are skipped, * matches any run of characters, slashes included, and ? a single one.
+func loadRoleAllowlist(filename string) (func(*saml2aws.AWSRole) bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open the role allowlist %s.", filename)
+	}
+	defer f.Close()
+
+	patterns := []*regexp.Regexp{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, globToRegexp(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "Unable to read the role allowlist %s.", filename)
+	}
+
+	return func(awsRole *saml2aws.AWSRole) bool {
+		for _, pattern := range patterns {
+			if pattern.MatchString(awsRole.RoleARN) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// globToRegexp the anchored regexp of an allowlist glob
+func globToRegexp(glob string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String())
+}
+
+// cachedRoleAllowedAWS whether the allowlist, if any, permits the role of cached credentials, which were possibly
+// cached before the allowlist changed
+func cachedRoleAllowedAWS(roleARN string, opts *AWSLoginOptions) bool {
+	if opts.AllowedRoleARNsFile == "" {
+		return true
+	}
+
+	allowed, err := loadRoleAllowlist(opts.AllowedRoleARNsFile)
+	if err != nil {
+		return false
+	}
+
+	return allowed(&saml2aws.AWSRole{RoleARN: roleARN})
+}
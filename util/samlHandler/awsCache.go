@@ -0,0 +1,242 @@
+package samllogin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/atomicfile"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// EnvCacheDir the environment variable relocating the credentials cache, see AWSLoginOptions.CacheDir
+const EnvCacheDir = "MCLOAK_CACHE_DIR"
+
+const (
+	// credentialsCacheSubdir the directory of the credentials cache within the user cache directory
+	credentialsCacheSubdir = "mcloak"
+
+	// credentialsCacheMinValidity cached credentials expiring sooner than this are not reused
+	credentialsCacheMinValidity = 5 * time.Minute
+)
+
+// credentialsCacheKey every input of the login changing the credentials STS hands out, hashed into the name of
+// the cache file so logins asking for different credentials never share one
+type credentialsCacheKey struct {
+	Profile      string `json:"profile,omitempty"`
+	RoleARN      string `json:"roleArn"`
+	ChainRoleARN string `json:"chainRoleArn,omitempty"`
+
+	// the session policies scope the credentials down, a scoped login must never get an unscoped session
+	SessionPolicy     string   `json:"sessionPolicy,omitempty"`
+	SessionPolicyARNs []string `json:"sessionPolicyArns,omitempty"`
+
+	// DurationSeconds the session duration asked for, a short one-off session isn't served a longer cached one
+	DurationSeconds int64 `json:"durationSeconds"`
+
+	// Region the region of the role as configured, RoleRegions applied, and the partition it must belong to
+	Region    string `json:"region,omitempty"`
+	Partition string `json:"partition,omitempty"`
+}
+
+// cachedCredentials a credentials cache file: the credentials and the role they were issued for, resolved from
+// the configured role_arn, along with the region that role was given
+type cachedCredentials struct {
+	awsconfig.AWSCredentials
+
+	RoleARN    string `json:"roleArn"`
+	RoleRegion string `json:"roleRegion,omitempty"`
+}
+
+// credentialsCachePath the cache file of the credentials of roleARN for the account, see credentialsCacheKey
+func credentialsCachePath(account *awscfg.IDPAccount, roleARN string, opts *AWSLoginOptions) (string, error) {
+	dir, err := credentialsCacheDir(opts)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := json.Marshal(credentialsCacheKey{
+		Profile:      cacheProfile(opts),
+		RoleARN:      roleARN,
+		ChainRoleARN: opts.ChainRoleARN,
+
+		SessionPolicy:     opts.SessionPolicy,
+		SessionPolicyARNs: sortedCopy(opts.SessionPolicyARNs),
+
+		DurationSeconds: cachedSessionDuration(account, opts),
+
+		Region:    roleRegion(account, roleARN, opts),
+		Partition: opts.Partition,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal the credentials cache key")
+	}
+	keyHash := sha256.Sum256(key)
+
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.json", accountName(account), hex.EncodeToString(keyHash[:]))), nil
+}
+
+// cachedSessionDuration the duration of the session handed out to the account, the chained role capped at an
+// hour. 0 when out of range, the login then fails before anything is cached.
+func cachedSessionDuration(account *awscfg.IDPAccount, opts *AWSLoginOptions) int64 {
+	duration, err := resolveSessionDuration(account, opts)
+	if err != nil {
+		return 0
+	}
+
+	if opts.ChainRoleARN != "" && duration > maxChainedSessionDuration {
+		return maxChainedSessionDuration
+	}
+
+	return duration
+}
+
+// sortedCopy a sorted copy of values, nil when empty
+func sortedCopy(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// credentialsCacheDir where the cached AWS credentials are stored: CacheDir, else MCLOAK_CACHE_DIR, else mcloak
+// in the user cache directory (XDG_CACHE_HOME or ~/.cache on Linux, ~/Library/Caches on macOS, %LocalAppData%
+// on Windows)
+func credentialsCacheDir(opts *AWSLoginOptions) (string, error) {
+	dir := opts.CacheDir
+	if dir == "" {
+		dir = os.Getenv(EnvCacheDir)
+	}
+	if dir != "" {
+		expanded, err := homedir.Expand(dir)
+		if err != nil {
+			return "", errors.Wrapf(err, "unable to expand the credentials cache directory %s", dir)
+		}
+		return expanded, nil
+	}
+
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to locate the credentials cache directory")
+	}
+
+	return filepath.Join(userCacheDir, credentialsCacheSubdir), nil
+}
+
+// cacheProfile the AWS profile the credentials are cached for, if any
+func cacheProfile(opts *AWSLoginOptions) string {
+	if opts.CacheProfile != "" {
+		return opts.CacheProfile
+	}
+
+	return os.Getenv("AWS_PROFILE")
+}
+
+// accountName identifies the account, its name or else its profile
+func accountName(account *awscfg.IDPAccount) string {
+	if account.Name != "" {
+		return account.Name
+	}
+
+	return account.Profile
+}
+
+// loadCachedCredentials returns the cached credentials of the account, or nil when there are none still valid.
+// Only a configured role_arn is looked up, any other role is only known once the IdP answered. The role_arn may
+// name the role by a suffix of its ARN, so the allowlist and RoleRegions are checked against the role it resolved to.
+func loadCachedCredentials(account *awscfg.IDPAccount, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if account.RoleARN == "" {
+		return nil, nil
+	}
+
+	filename, err := credentialsCachePath(account, account.RoleARN, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "unable to read credentials cache %s", filename)
+	}
+
+	cached := new(cachedCredentials)
+	err = json.Unmarshal(data, cached)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse credentials cache %s", filename)
+	}
+
+	// written before the resolved role was recorded, nothing to check the allowlist against
+	if cached.RoleARN == "" {
+		return nil, nil
+	}
+
+	if cached.IsExpiringAt(opts.now(), credentialsCacheMinValidity) {
+		return nil, nil
+	}
+
+	if !cachedRoleAllowedAWS(cached.RoleARN, opts) {
+		logger.WithField("role", cached.RoleARN).Warn("Ignoring cached credentials of a role the allowlist doesn't permit.")
+		return nil, nil
+	}
+
+	if roleRegion(account, cached.RoleARN, opts) != cached.RoleRegion {
+		return nil, nil
+	}
+
+	return &cached.AWSCredentials, nil
+}
+
+// roleRegion the region the role is given for the account, RoleRegions applied
+func roleRegion(account *awscfg.IDPAccount, roleARN string, opts *AWSLoginOptions) string {
+	return withRoleRegion(account, &saml2aws.AWSRole{RoleARN: roleARN}, opts).Region
+}
+
+// saveCachedCredentials stores the credentials of roleARN, the role the configured role_arn resolved to, in the
+// cache file of the account. Without a configured role_arn they would never be looked up, so they aren't stored.
+func saveCachedCredentials(account *awscfg.IDPAccount, roleARN string, opts *AWSLoginOptions, awsCreds *awsconfig.AWSCredentials) error {
+	if account.RoleARN == "" {
+		return nil
+	}
+
+	filename, err := credentialsCachePath(account, account.RoleARN, opts)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the credentials cache directory")
+	}
+
+	data, err := json.Marshal(cachedCredentials{
+		AWSCredentials: *awsCreds,
+		RoleARN:        roleARN,
+		RoleRegion:     roleRegion(account, roleARN, opts),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal credentials")
+	}
+
+	err = atomicfile.WriteFile(filename, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to write credentials cache %s", filename)
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package samllogin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsCacheKeyedByProfile(t *testing.T) {
+	useTempHome(t)
+	t.Setenv("AWS_PROFILE", "")
+
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+
+	devCreds := &awsconfig.AWSCredentials{AWSAccessKey: "ASIADEV", Expires: time.Now().Add(time.Hour)}
+	prodCreds := &awsconfig.AWSCredentials{AWSAccessKey: "ASIAPROD", Expires: time.Now().Add(time.Hour)}
+
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, &AWSLoginOptions{CacheProfile: "dev"}, devCreds))
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, &AWSLoginOptions{CacheProfile: "prod"}, prodCreds))
+
+	cached, err := loadCachedCredentials(account, &AWSLoginOptions{CacheProfile: "dev"})
+	require.Nil(t, err)
+	require.NotNil(t, cached)
+	assert.Equal(t, "ASIADEV", cached.AWSAccessKey)
+
+	// AWS_PROFILE picks the cache when no profile is given
+	t.Setenv("AWS_PROFILE", "prod")
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{})
+	require.Nil(t, err)
+	require.NotNil(t, cached)
+	assert.Equal(t, "ASIAPROD", cached.AWSAccessKey)
+
+	t.Setenv("AWS_PROFILE", "")
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.Nil(t, cached, "no profile has a cache of its own")
+}
+
+// fixedClock a Clock stopped at the given time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestLoadCachedCredentialsUsesClock(t *testing.T) {
+	useTempHome(t)
+
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, &AWSLoginOptions{}, testCreds))
+
+	// testCreds expire at 2024-01-02T03:04:05Z
+	cached, err := loadCachedCredentials(account, &AWSLoginOptions{Clock: fixedClock(testCreds.Expires.Add(-time.Hour))})
+	require.Nil(t, err)
+	require.NotNil(t, cached)
+	assert.Equal(t, testCreds.AWSAccessKey, cached.AWSAccessKey)
+
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{Clock: fixedClock(testCreds.Expires.Add(-time.Minute))})
+	require.Nil(t, err)
+	assert.Nil(t, cached, "credentials within minutes of their expiry are not reused")
+
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.Nil(t, cached, "the system clock is the default")
+}
+
+func TestCredentialsCacheKeyedByRole(t *testing.T) {
+	useTempHome(t)
+
+	account := newTestIDPAccount()
+	adminPath, err := credentialsCachePath(account, testAdminRoleARN, &AWSLoginOptions{})
+	require.Nil(t, err)
+	readPath, err := credentialsCachePath(account, testReadRoleARN, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.NotEqual(t, adminPath, readPath)
+
+	// without a role_arn the role is picked after the IdP answered, each login must get its own credentials
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN, testReadRoleARN))
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+	login := func(roleFilter string) {
+		opts := &AWSLoginOptions{
+			NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+				return &fakeSAMLProvider{assertion: assertion}, nil
+			},
+			STSClient:  fake,
+			RoleFilter: roleFilter,
+		}
+		loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+		result, err := LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+		require.Nil(t, err)
+		require.NotNil(t, result.Role, "the credentials don't come from the cache")
+	}
+
+	login("Admin$")
+	login("ReadOnly$")
+
+	require.Equal(t, 2, fake.calls)
+	assert.Equal(t, testAdminRoleARN, aws.StringValue(fake.inputs[0].RoleArn))
+	assert.Equal(t, testReadRoleARN, aws.StringValue(fake.inputs[1].RoleArn))
+}
+
+func TestLoadCachedCredentialsHonoursAllowlist(t *testing.T) {
+	useTempHome(t)
+
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+	awsCreds := &awsconfig.AWSCredentials{AWSAccessKey: "ASIAEXAMPLE", Expires: time.Now().Add(time.Hour)}
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, &AWSLoginOptions{}, awsCreds))
+
+	allowlist := filepath.Join(t.TempDir(), "allowed-roles")
+	require.Nil(t, os.WriteFile(allowlist, []byte("arn:aws:iam::123456789012:role/*\n"), 0600))
+
+	cached, err := loadCachedCredentials(account, &AWSLoginOptions{AllowedRoleARNsFile: allowlist})
+	require.Nil(t, err)
+	assert.NotNil(t, cached)
+
+	require.Nil(t, os.WriteFile(allowlist, []byte(testReadRoleARN+"\n"), 0600))
+
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{AllowedRoleARNsFile: allowlist})
+	require.Nil(t, err)
+	assert.Nil(t, cached, "roles no longer allowed aren't served from the cache")
+}
+
+// cachingLogin logs into the role_arn of the test account through the credentials cache, tuned by opts
+func cachingLogin(t *testing.T, fake *fakeSTS, opts AWSLoginOptions) *LoginResult {
+	return cachingLoginAs(t, fake, testAdminRoleARN, opts)
+}
+
+// cachingLoginAs cachingLogin with the role_arn of the test account set to roleARN
+func cachingLoginAs(t *testing.T, fake *fakeSTS, roleARN string, opts AWSLoginOptions) *LoginResult {
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	opts.NewSAMLProvider = func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+		return &fakeSAMLProvider{assertion: assertion}, nil
+	}
+	opts.STSClient = fake
+
+	account := newTestIDPAccount()
+	account.RoleARN = roleARN
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	result, err := LoginAWSWithResult(context.Background(), account, loginDetails, &opts)
+	require.Nil(t, err)
+	return result
+}
+
+func TestCredentialsCacheHitsForRoleName(t *testing.T) {
+	useTempHome(t)
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+
+	cachingLoginAs(t, fake, "Admin", AWSLoginOptions{})
+	result := cachingLoginAs(t, fake, "Admin", AWSLoginOptions{})
+	require.Equal(t, 1, fake.calls, "a role_arn naming the role is served from the cache")
+	assert.Nil(t, result.Role)
+
+	cachingLoginAs(t, fake, "role/Admin", AWSLoginOptions{})
+	cachingLoginAs(t, fake, "role/Admin", AWSLoginOptions{})
+	require.Equal(t, 2, fake.calls)
+
+	// the allowlist and RoleRegions name the role it resolved to
+	allowlist := filepath.Join(t.TempDir(), "allowed-roles")
+	require.Nil(t, os.WriteFile(allowlist, []byte(testReadRoleARN+"\n"), 0600))
+	account := newTestIDPAccount()
+	account.RoleARN = "Admin"
+	cached, err := loadCachedCredentials(account, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.NotNil(t, cached)
+	cached, err = loadCachedCredentials(account, &AWSLoginOptions{AllowedRoleARNsFile: allowlist})
+	require.Nil(t, err)
+	assert.Nil(t, cached, "roles no longer allowed aren't served from the cache")
+
+	result = cachingLoginAs(t, fake, "Admin", AWSLoginOptions{RoleRegions: map[string]string{testAdminRoleARN: "eu-west-1"}})
+	require.Equal(t, 3, fake.calls, "the credentials of another region aren't served from the cache")
+	assert.Equal(t, "eu-west-1", result.Credentials.Region)
+}
+
+func TestCredentialsCacheKeyedBySessionPolicy(t *testing.T) {
+	useTempHome(t)
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+
+	cachingLogin(t, fake, AWSLoginOptions{})
+	cachingLogin(t, fake, AWSLoginOptions{})
+	require.Equal(t, 1, fake.calls, "the unscoped session is cached")
+
+	policy := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+	cachingLogin(t, fake, AWSLoginOptions{SessionPolicy: policy})
+	require.Equal(t, 2, fake.calls, "a scoped login never gets the cached unscoped session")
+	assert.Equal(t, policy, aws.StringValue(fake.inputs[1].Policy))
+
+	policyARNs := []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::aws:policy/AWSBillingReadOnlyAccess"}
+	cachingLogin(t, fake, AWSLoginOptions{SessionPolicyARNs: policyARNs})
+	require.Equal(t, 3, fake.calls)
+
+	cachingLogin(t, fake, AWSLoginOptions{SessionPolicyARNs: []string{policyARNs[1], policyARNs[0]}})
+	assert.Equal(t, 3, fake.calls, "the order of the policy ARNs doesn't matter")
+}
+
+func TestCredentialsCacheKeyedByDuration(t *testing.T) {
+	useTempHome(t)
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+
+	cachingLogin(t, fake, AWSLoginOptions{})
+	require.Equal(t, 1, fake.calls)
+
+	cachingLogin(t, fake, AWSLoginOptions{DurationOverride: 15 * time.Minute})
+	require.Equal(t, 2, fake.calls, "a one-off short session isn't served the cached longer one")
+	assert.Equal(t, int64(900), aws.Int64Value(fake.inputs[1].DurationSeconds))
+
+	cachingLogin(t, fake, AWSLoginOptions{DurationOverride: time.Hour})
+	assert.Equal(t, 2, fake.calls, "an override matching the account duration shares its cache")
+}
+
+func TestCredentialsCacheKeyedByRegion(t *testing.T) {
+	useTempHome(t)
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+
+	result := cachingLogin(t, fake, AWSLoginOptions{})
+	require.Equal(t, 1, fake.calls)
+	assert.Equal(t, "us-east-1", result.Credentials.Region)
+
+	roleRegions := map[string]string{testAdminRoleARN: "eu-west-1"}
+	result = cachingLogin(t, fake, AWSLoginOptions{RoleRegions: roleRegions})
+	require.Equal(t, 2, fake.calls, "the credentials of another region aren't served from the cache")
+	assert.Equal(t, "eu-west-1", result.Credentials.Region)
+
+	result = cachingLogin(t, fake, AWSLoginOptions{RoleRegions: roleRegions})
+	assert.Equal(t, 2, fake.calls)
+	assert.Equal(t, "eu-west-1", result.Credentials.Region)
+
+	cachingLogin(t, fake, AWSLoginOptions{Partition: "aws"})
+	assert.Equal(t, 3, fake.calls)
+}
+
+func TestCredentialsCacheDir(t *testing.T) {
+	useTempHome(t)
+	home := os.Getenv("HOME")
+
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, "xdg"))
+	dir, err := credentialsCacheDir(&AWSLoginOptions{})
+	require.Nil(t, err)
+	if runtime.GOOS == "linux" {
+		assert.Equal(t, filepath.Join(home, "xdg", "mcloak"), dir)
+	}
+
+	t.Setenv(EnvCacheDir, "~/cache")
+	dir, err = credentialsCacheDir(&AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, filepath.Join(home, "cache"), dir)
+
+	custom := filepath.Join(t.TempDir(), "custom")
+	opts := &AWSLoginOptions{CacheDir: custom}
+	dir, err = credentialsCacheDir(opts)
+	require.Nil(t, err)
+	assert.Equal(t, custom, dir)
+
+	awsCreds := &awsconfig.AWSCredentials{AWSAccessKey: "ASIAEXAMPLE", Expires: time.Now().Add(time.Hour)}
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, opts, awsCreds))
+
+	info, err := os.Stat(custom)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
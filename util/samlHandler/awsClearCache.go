@@ -0,0 +1,150 @@
+package samllogin
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// cachedCredentialsFile matches the cache files written by saveCachedCredentials, capturing the account name
+var cachedCredentialsFile = regexp.MustCompile(`^(.+)-[0-9a-f]{64}\.json$`)
+
+// ClearCache forgets everything kept between the logins of the named account of ~/.saml2aws: its cached
+// credentials, its remembered role and its IdP session cookies. Nothing being cached is not an error.
+func ClearCache(accountName string) error {
+	return ClearCacheWithOptions(accountName, nil)
+}
+
+// ClearCacheWithOptions runs ClearCache on the credentials cache in opts.CacheDir and the account of the
+// saml2aws configuration file at opts.ConfigPath, a nil opts behaves like ClearCache
+func ClearCacheWithOptions(accountName string, opts *AWSLoginOptions) error {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	err := removeCachedCredentials(opts, func(name string) bool { return name == accountName })
+	if err != nil {
+		return err
+	}
+
+	err = forgetRoleSelection(accountName)
+	if err != nil {
+		return err
+	}
+
+	return removeCookieJars(opts.ConfigPath, func(name string) bool { return name == accountName })
+}
+
+// ClearAllCaches forgets everything kept between the logins of any account, as ClearCache does for one
+func ClearAllCaches() error {
+	return ClearAllCachesWithOptions(nil)
+}
+
+// ClearAllCachesWithOptions runs ClearAllCaches on the credentials cache in opts.CacheDir and the accounts of the
+// saml2aws configuration file at opts.ConfigPath, a nil opts behaves like ClearAllCaches
+func ClearAllCachesWithOptions(opts *AWSLoginOptions) error {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	err := removeCachedCredentials(opts, func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+
+	filename, err := homedir.Expand(roleSelectionsFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to locate the role selections file")
+	}
+	err = removeIfExists(filename)
+	if err != nil {
+		return err
+	}
+
+	return removeCookieJars(opts.ConfigPath, func(string) bool { return true })
+}
+
+// removeCachedCredentials deletes the credentials cache files of the accounts whose name matches
+func removeCachedCredentials(opts *AWSLoginOptions, match func(name string) bool) error {
+	dir, err := credentialsCacheDir(opts)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "unable to list the credentials cache %s", dir)
+	}
+
+	for _, entry := range entries {
+		m := cachedCredentialsFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil || !match(m[1]) {
+			continue
+		}
+
+		err = removeIfExists(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeCookieJars deletes the cookie_jar_file of the accounts of the saml2aws configuration file at configPath,
+// ~/.saml2aws when empty, whose name matches
+func removeCookieJars(configPath string, match func(name string) bool) error {
+	configManager, err := awscfg.NewConfigManager(configPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to load the saml2aws configuration")
+	}
+
+	names, err := configManager.IDPAccountNames()
+	if err != nil {
+		return errors.Wrap(err, "unable to load the saml2aws configuration")
+	}
+
+	for _, name := range names {
+		if !match(name) {
+			continue
+		}
+
+		account, err := configManager.LoadIDPAccount(name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to load the idp account %s", name)
+		}
+		if account.CookieJarFile == "" {
+			continue
+		}
+
+		filename, err := homedir.Expand(account.CookieJarFile)
+		if err != nil {
+			return errors.Wrapf(err, "unable to expand the cookie jar file %s", account.CookieJarFile)
+		}
+
+		err = removeIfExists(filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeIfExists deletes filename, it not existing is fine
+func removeIfExists(filename string) error {
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "unable to remove %s", filename)
+	}
+
+	return nil
+}
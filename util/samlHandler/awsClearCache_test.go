@@ -0,0 +1,98 @@
+package samllogin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClearCache(t *testing.T) {
+	useTempHome(t)
+	home := os.Getenv("HOME")
+
+	testJar := filepath.Join(home, "test-cookies.json")
+	otherJar := filepath.Join(home, "other-cookies.json")
+	config := "[test]\ncookie_jar_file = ~/test-cookies.json\n\n[other]\ncookie_jar_file = ~/other-cookies.json\n"
+	require.Nil(t, os.WriteFile(filepath.Join(home, ".saml2aws"), []byte(config), 0600))
+
+	test := newTestIDPAccount()
+	test.RoleARN = testAdminRoleARN
+	other := newTestIDPAccount()
+	other.Name = "other"
+	other.RoleARN = testAdminRoleARN
+
+	for _, jar := range []string{testJar, otherJar} {
+		require.Nil(t, os.WriteFile(jar, []byte("[]"), 0600))
+	}
+	testCache, err := credentialsCachePath(test, test.RoleARN, &AWSLoginOptions{})
+	require.Nil(t, err)
+	otherCache, err := credentialsCachePath(other, other.RoleARN, &AWSLoginOptions{})
+	require.Nil(t, err)
+	require.Nil(t, saveCachedCredentials(test, test.RoleARN, &AWSLoginOptions{}, testCreds))
+	require.Nil(t, saveCachedCredentials(other, other.RoleARN, &AWSLoginOptions{}, testCreds))
+	require.Nil(t, saveRoleSelection(test, testAdminRoleARN))
+	require.Nil(t, saveRoleSelection(other, testReadRoleARN))
+
+	require.Nil(t, ClearCache("test"))
+
+	assert.NoFileExists(t, testCache)
+	assert.NoFileExists(t, testJar)
+	assert.FileExists(t, otherCache)
+	assert.FileExists(t, otherJar)
+
+	selections, err := loadRoleSelections()
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"other": testReadRoleARN}, selections)
+
+	require.Nil(t, ClearCache("test"), "nothing left to clear is fine")
+
+	require.Nil(t, ClearAllCaches())
+
+	assert.NoFileExists(t, otherCache)
+	assert.NoFileExists(t, otherJar)
+	assert.NoFileExists(t, filepath.Join(home, ".mcloak", "selections.json"))
+
+	require.Nil(t, ClearAllCaches(), "nothing left to clear is fine")
+}
+
+func TestClearCacheWithOptions(t *testing.T) {
+	useTempHome(t)
+	dir := t.TempDir()
+
+	jar := filepath.Join(dir, "cookies.json")
+	require.Nil(t, os.WriteFile(jar, []byte("[]"), 0600))
+	configPath := filepath.Join(dir, "project.saml2aws")
+	require.Nil(t, os.WriteFile(configPath, []byte("[test]\ncookie_jar_file = "+jar+"\n"), 0600))
+
+	opts := &AWSLoginOptions{CacheDir: filepath.Join(dir, "cache"), ConfigPath: configPath}
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, opts, testCreds))
+	cachePath, err := credentialsCachePath(account, account.RoleARN, opts)
+	require.Nil(t, err)
+
+	require.Nil(t, ClearCache("test"))
+	assert.FileExists(t, cachePath, "the default locations don't know about the custom ones")
+	assert.FileExists(t, jar)
+
+	require.Nil(t, ClearCacheWithOptions("test", opts))
+	assert.NoFileExists(t, cachePath)
+	assert.NoFileExists(t, jar)
+
+	require.Nil(t, os.WriteFile(jar, []byte("[]"), 0600))
+	require.Nil(t, saveCachedCredentials(account, account.RoleARN, opts, testCreds))
+
+	require.Nil(t, ClearAllCachesWithOptions(opts))
+	assert.NoFileExists(t, cachePath)
+	assert.NoFileExists(t, jar)
+}
+
+func TestClearAllCachesWithoutAnything(t *testing.T) {
+	useTempHome(t)
+
+	assert.Nil(t, ClearAllCaches())
+	assert.Nil(t, ClearCache("test"))
+}
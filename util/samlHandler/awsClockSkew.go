@@ -0,0 +1,103 @@
+package samllogin
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// clockSkewWarnThreshold a skew above this is logged
+	clockSkewWarnThreshold = time.Minute
+
+	// clockSkewMaxThreshold a skew above this fails the login with ErrClockSkew
+	clockSkewMaxThreshold = 5 * time.Minute
+
+	// clockSkewTimeout how long the reference clock is waited for
+	clockSkewTimeout = 5 * time.Second
+)
+
+// ErrClockSkew is returned when the local clock is too far off for the SAML assertion and STS to be accepted
+var ErrClockSkew = errors.New("local clock is skewed, please synchronize it")
+
+// checkClockSkew compares the local clock with the Date header served by url. It only fails with ErrClockSkew,
+// an unreachable url is logged and ignored as the login may well succeed regardless.
+func checkClockSkew(ctx context.Context, httpClient *http.Client, url string) error {
+	skew, err := measureClockSkew(ctx, httpClient, url)
+	if err != nil {
+		logger.WithError(err).WithField("url", url).Debug("Unable to check the clock skew.")
+		return nil
+	}
+
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew > clockSkewMaxThreshold {
+		return errors.Wrapf(ErrClockSkew, "Local clock differs by %s from %s", skew.Round(time.Second), url)
+	}
+	if skew > clockSkewWarnThreshold {
+		logger.WithField("skew", skew.Round(time.Second).String()).Warn("Local clock is skewed, SAML and STS requests may be refused.")
+	}
+
+	return nil
+}
+
+// measureClockSkew how far the local clock is ahead of the Date header served by url
+func measureClockSkew(ctx context.Context, httpClient *http.Client, url string) (time.Duration, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clockSkewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error building clock skew request")
+	}
+
+	sent := time.Now()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "error requesting the reference clock")
+	}
+	defer res.Body.Close()
+	received := time.Now()
+
+	remote, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, errors.Wrap(err, "error parsing the Date header")
+	}
+
+	// the server stamped the response somewhere between sent and received
+	local := sent.Add(received.Sub(sent) / 2)
+
+	return local.Sub(remote), nil
+}
+
+// clockSkewURL the URL whose Date header is the reference clock, the STS endpoint unless overridden
+func clockSkewURL(region string, opts *AWSLoginOptions) string {
+	if opts.ClockSkewURL != "" {
+		return opts.ClockSkewURL
+	}
+
+	return stsEndpointURL(region, opts)
+}
+
+// stsEndpointURL the URL of the STS endpoint of the region
+func stsEndpointURL(region string, opts *AWSLoginOptions) string {
+	endpoint := resolveSTSEndpoint(region, opts)
+	if endpoint == "" {
+		endpoint = "sts." + region + ".amazonaws.com"
+	}
+
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+
+	return "https://" + endpoint
+}
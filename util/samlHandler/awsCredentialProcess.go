@@ -0,0 +1,78 @@
+package samllogin
+
+import (
+	"context"
+	"time"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// credentialProcessMinValidity cached credentials expiring sooner than this aren't handed to the AWS CLI,
+// the SDKs refresh process credentials ahead of expiry and would call again straight away
+const credentialProcessMinValidity = 15 * time.Minute
+
+// mfaTokenInteractionRequired the MFATokenProvider of credential_process and the credential server without one
+// configured, the IdP asking for a token the login details don't carry needs the user
+func mfaTokenInteractionRequired() (string, error) {
+	return "", newLoginError(ErrInteractionRequired, errors.New("the IdP asks for an MFA token"),
+		"Login requires an MFA token, configure MFATokenProvider or log in interactively once to refresh the IdP session.")
+}
+
+// cacheFresh whether the cached credentials were issued less than CacheTTL ago, always true without a CacheTTL.
+// They were issued a session duration before their expiry.
+func cacheFresh(cachedCreds *awsconfig.AWSCredentials, account *awscfg.IDPAccount, opts *AWSLoginOptions) bool {
+	if opts.CacheTTL <= 0 {
+		return true
+	}
+
+	duration := cachedSessionDuration(account, opts)
+	if duration == 0 || cachedCreds.Expires.IsZero() {
+		return false
+	}
+
+	issued := cachedCreds.Expires.Add(-time.Duration(duration) * time.Second)
+	return opts.now().Sub(issued) < opts.CacheTTL
+}
+
+// CredentialProcessAWS serves an AWS credential_process invocation: it writes the cached credentials while
+// they are valid long enough, otherwise logs in again without ever prompting, relying on the login details
+// and the persisted IdP session. When the login needs user interaction the error says so, returned to the
+// caller to exit non-zero so the AWS CLI surfaces it. stdout only ever carries the credential_process JSON.
+func CredentialProcessAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) error {
+	processOpts := AWSLoginOptions{}
+	if opts != nil {
+		processOpts = *opts
+	}
+	processOpts.NonInteractive = true
+	processOpts.WriteCredentialsFile = false
+	if processOpts.MFATokenProvider == nil {
+		// the AWS CLI waits on the process, a terminal prompt for the token would hang it
+		processOpts.MFATokenProvider = mfaTokenInteractionRequired
+	}
+
+	sink := &CredentialProcessSink{}
+
+	if !processOpts.ForceRefresh && !processOpts.NoCache {
+		cachedCreds, err := loadCachedCredentials(account, &processOpts)
+		if err != nil {
+			logger.WithError(err).Warn("Ignoring credentials cache.")
+		} else if !cachedCreds.IsExpiringAt(processOpts.now(), credentialProcessMinValidity) && cacheFresh(cachedCreds, account, &processOpts) {
+			return sink.Write(cachedCreds)
+		}
+	}
+	processOpts.ForceRefresh = true
+
+	awsCreds, err := LoginAWSWithOptions(ctx, account, loginDetails, &processOpts)
+	if errors.Is(err, ErrRoleSelectionRequired) {
+		return errors.Wrap(err, "Login requires choosing a role, configure role_arn for the credential_process profile.")
+	}
+	if err != nil {
+		return errors.Wrap(err, "Unable to log in non-interactively, log in interactively once to refresh the IdP session.")
+	}
+
+	return sink.Write(awsCreds)
+}
@@ -0,0 +1,123 @@
+package samllogin
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialProcessAWSReusesCacheWithinValidity(t *testing.T) {
+	useTempHome(t)
+	t.Setenv("AWS_PROFILE", "")
+
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	provider := &flakySAMLProvider{fakeSAMLProvider: fakeSAMLProvider{assertion: assertion}}
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	invoke := func(opts AWSLoginOptions) map[string]interface{} {
+		opts.NewSAMLProvider = func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			return provider, nil
+		}
+		opts.STSClient = fake
+
+		out := captureStdout(t, func() {
+			assert.Nil(t, CredentialProcessAWS(context.Background(), account, loginDetails, &opts))
+		})
+
+		var credProcess map[string]interface{}
+		require.Nil(t, json.NewDecoder(strings.NewReader(out)).Decode(&credProcess))
+		return credProcess
+	}
+
+	// the AWS CLI calling again and again while the credentials are valid
+	for i := 0; i < 3; i++ {
+		credProcess := invoke(AWSLoginOptions{})
+		assert.Equal(t, "ASIAEXAMPLE", credProcess["AccessKeyId"])
+	}
+	assert.Equal(t, 1, provider.calls)
+	assert.Equal(t, 1, fake.calls)
+
+	// a stale cache is no longer handed out
+	invoke(AWSLoginOptions{CacheTTL: time.Nanosecond})
+	assert.Equal(t, 2, provider.calls)
+
+	// credentials within the refresh window aren't either
+	fake.expiration = time.Now().Add(10 * time.Minute)
+	invoke(AWSLoginOptions{ForceRefresh: true})
+	invoke(AWSLoginOptions{})
+	assert.Equal(t, 4, provider.calls)
+}
+
+func TestCredentialProcessAWSFailsWhenMFATokenRequired(t *testing.T) {
+	useTempHome(t)
+	t.Setenv("AWS_PROFILE", "")
+
+	server := newKeycloakServer(t, `<html><body><form id="kc-otp-login-form" action="/login-actions/otp" method="post">
+<input id="otp" name="otp"/></form></body></html>`)
+
+	account := newTestIDPAccount()
+	account.URL = server.URL
+	account.RoleARN = testAdminRoleARN
+	loginDetails := &awscreds.LoginDetails{URL: server.URL, Username: "alice", Password: "secret"}
+
+	out := captureStdout(t, func() {
+		err := CredentialProcessAWS(context.Background(), account, loginDetails, &AWSLoginOptions{IdPAttempts: 1})
+		require.NotNil(t, err)
+		assert.True(t, errors.Is(err, ErrInteractionRequired))
+		assert.True(t, errors.Is(err, ErrAuthenticate))
+		assert.Contains(t, err.Error(), "MFA token")
+	})
+	assert.Empty(t, out)
+}
+
+func TestCredentialServerNeverPrompts(t *testing.T) {
+	useTempHome(t)
+	t.Setenv("AWS_PROFILE", "")
+
+	server := newKeycloakServer(t, `<html><body><form id="kc-otp-login-form" action="/login-actions/otp" method="post">
+<input id="otp" name="otp"/></form></body></html>`)
+
+	account := newTestIDPAccount()
+	account.URL = server.URL
+	account.RoleARN = testAdminRoleARN
+	loginDetails := &awscreds.LoginDetails{URL: server.URL, Username: "alice", Password: "secret"}
+
+	credentialServer, err := NewCredentialServer(account, loginDetails, &AWSLoginOptions{IdPAttempts: 1}, 0, "")
+	require.Nil(t, err)
+	defer credentialServer.listener.Close()
+
+	_, err = credentialServer.credentials(context.Background())
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrInteractionRequired))
+	assert.True(t, credentialServer.opts.NonInteractive)
+}
+
+func TestCacheFreshJudgedOnExpiry(t *testing.T) {
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+
+	// issued at 2024-01-02T02:04:05Z, an hour before it expires
+	issued := testCreds.Expires.Add(-time.Hour)
+
+	assert.True(t, cacheFresh(testCreds, account, &AWSLoginOptions{}), "always fresh without a CacheTTL")
+	assert.True(t, cacheFresh(testCreds, account, &AWSLoginOptions{CacheTTL: 10 * time.Minute, Clock: fixedClock(issued.Add(9 * time.Minute))}))
+	assert.False(t, cacheFresh(testCreds, account, &AWSLoginOptions{CacheTTL: 10 * time.Minute, Clock: fixedClock(issued.Add(11 * time.Minute))}))
+
+	// the chained role session lasts an hour at most
+	account.SessionDuration = 4 * 3600
+	assert.True(t, cacheFresh(testCreds, account, &AWSLoginOptions{CacheTTL: 10 * time.Minute, ChainRoleARN: testReadRoleARN, Clock: fixedClock(issued.Add(9 * time.Minute))}))
+}
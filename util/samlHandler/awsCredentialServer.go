@@ -0,0 +1,149 @@
+package samllogin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// credentialServerRefreshWindow credentials are refreshed once they expire sooner than this
+const credentialServerRefreshWindow = 15 * time.Minute
+
+// CredentialServer serves the credentials of an account on 127.0.0.1 in the format of the ECS container
+// credentials endpoint, so any SDK picks them up with AWS_CONTAINER_CREDENTIALS_FULL_URI. They are logged
+// into on the first request and refreshed when near expiry.
+type CredentialServer struct {
+	account      *awscfg.IDPAccount
+	loginDetails *awscreds.LoginDetails
+	opts         *AWSLoginOptions
+	authToken    string
+
+	mu       sync.Mutex
+	awsCreds *awsconfig.AWSCredentials
+
+	listener net.Listener
+	server   *http.Server
+}
+
+// ecsCredentials the ECS container credentials response
+type ecsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+	Expiration      string `json:"Expiration"`
+	RoleArn         string `json:"RoleArn,omitempty"`
+}
+
+// NewCredentialServer listens on 127.0.0.1:port, 0 picks a free port. When authToken isn't empty requests
+// must carry it in the Authorization header, as set by the SDKs from AWS_CONTAINER_AUTHORIZATION_TOKEN.
+// Logins never prompt, one needing user interaction fails the request with ErrInteractionRequired.
+func NewCredentialServer(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions, port int, authToken string) (*CredentialServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to listen on port %d.", port)
+	}
+
+	// requests wait on the login, a terminal prompt for the role or the MFA token would hang them
+	serverOpts := AWSLoginOptions{}
+	if opts != nil {
+		serverOpts = *opts
+	}
+	serverOpts.NonInteractive = true
+	if serverOpts.MFATokenProvider == nil {
+		serverOpts.MFATokenProvider = mfaTokenInteractionRequired
+	}
+
+	s := &CredentialServer{
+		account:      account,
+		loginDetails: loginDetails,
+		opts:         &serverOpts,
+		authToken:    authToken,
+		listener:     listener,
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s, nil
+}
+
+// URL the value of AWS_CONTAINER_CREDENTIALS_FULL_URI
+func (s *CredentialServer) URL() string {
+	return "http://" + s.listener.Addr().String() + "/"
+}
+
+// Serve serves until Shutdown, it then returns nil
+func (s *CredentialServer) Serve() error {
+	logger.WithField("url", s.URL()).Info("Serving AWS credentials.")
+
+	err := s.server.Serve(s.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown stops accepting requests and waits for the ongoing ones until ctx is done
+func (s *CredentialServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// ServeHTTP implements http.Handler
+func (s *CredentialServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// constant time, the response carries live credentials
+	if s.authToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.authToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	awsCreds, err := s.credentials(r.Context())
+	if err != nil {
+		logger.WithError(err).Error("Unable to serve AWS credentials.")
+		http.Error(w, "unable to retrieve credentials", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ecsCredentials{
+		AccessKeyID:     awsCreds.AWSAccessKey,
+		SecretAccessKey: awsCreds.AWSSecretKey,
+		Token:           awsCreds.AWSSessionToken,
+		Expiration:      awsCreds.Expires.UTC().Format(time.RFC3339),
+		RoleArn:         s.account.RoleARN,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Error writing AWS credentials response.")
+	}
+}
+
+// credentials the current credentials, refreshed when near expiry. Concurrent requests wait for the same login.
+func (s *CredentialServer) credentials(ctx context.Context) (*awsconfig.AWSCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	awsCreds, err := RefreshAWS(ctx, s.account, s.loginDetails, s.awsCreds, credentialServerRefreshWindow, s.opts)
+	if err != nil {
+		return nil, err
+	}
+	s.awsCreds = awsCreds
+
+	return awsCreds, nil
+}
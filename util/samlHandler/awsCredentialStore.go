@@ -0,0 +1,36 @@
+package samllogin
+
+import (
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialStore hands out the IdP password of an account, e.g. from the OS keyring or a secrets manager,
+// see keyringstore for the keyring one
+type CredentialStore interface {
+	// GetPassword returns the password of the account, named after the IDP account or else its profile
+	GetPassword(account string) (string, error)
+}
+
+// withStoredPassword returns a copy of the login details with the password of the CredentialStore, when they
+// carry none
+func withStoredPassword(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (*awscreds.LoginDetails, error) {
+	if opts.CredentialStore == nil || loginDetails.Password != "" {
+		return loginDetails, nil
+	}
+
+	name := accountName(account)
+
+	password, err := opts.CredentialStore.GetPassword(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to get the password of account %s from the credential store.", name)
+	}
+
+	logger.WithField("account", name).Debug("Read the password from the credential store.")
+
+	storedDetails := *loginDetails
+	storedDetails.Password = password
+	return &storedDetails, nil
+}
@@ -0,0 +1,42 @@
+package samllogin
+
+import (
+	"testing"
+
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCredentialStore hands out the passwords of the accounts it knows
+type fakeCredentialStore map[string]string
+
+func (f fakeCredentialStore) GetPassword(account string) (string, error) {
+	password, ok := f[account]
+	if !ok {
+		return "", errors.New("not found")
+	}
+
+	return password, nil
+}
+
+func TestWithStoredPassword(t *testing.T) {
+	opts := &AWSLoginOptions{CredentialStore: fakeCredentialStore{"test": "stored"}}
+	loginDetails := &awscreds.LoginDetails{Username: "alice"}
+
+	stored, err := withStoredPassword(newTestIDPAccount(), loginDetails, opts)
+	require.Nil(t, err)
+	assert.Equal(t, "stored", stored.Password)
+	assert.Equal(t, "", loginDetails.Password)
+
+	typed, err := withStoredPassword(newTestIDPAccount(), &awscreds.LoginDetails{Password: "typed"}, opts)
+	require.Nil(t, err)
+	assert.Equal(t, "typed", typed.Password)
+
+	account := newTestIDPAccount()
+	account.Name = "unknown"
+	_, err = withStoredPassword(account, loginDetails, opts)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,69 @@
+package samllogin
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+
+	"github.com/pkg/errors"
+)
+
+// DumpRolesAWS writes every Role attribute of the assertion, how it splits into principal and role, and the
+// accounts AWS resolves them to as tables, to troubleshoot an IdP sending malformed roles
+func DumpRolesAWS(w io.Writer, samlAssertion string) error {
+	return dumpRolesAWS(w, samlAssertion, nil)
+}
+
+// dumpRolesAWS DumpRolesAWS resolving the accounts with httpClient, http.DefaultClient when nil
+func dumpRolesAWS(w io.Writer, samlAssertion string, httpClient *http.Client) error {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	roles, err := saml2aws.ExtractAwsRoles(data)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing SAML assertion.")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "#\tROLE ATTRIBUTE\tPRINCIPAL ARN\tROLE ARN\tERROR\n")
+	var awsRoles []*saml2aws.AWSRole
+	for i, role := range roles {
+		parsed, err := saml2aws.ParseAWSRoles([]string{role})
+		if err != nil {
+			fmt.Fprintf(tw, "%d\t%s\t\t\t%v\n", i+1, role, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t\n", i+1, role, parsed[0].PrincipalARN, parsed[0].RoleARN)
+		awsRoles = append(awsRoles, parsed[0])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\n%d role attribute(s), %d valid\n\n", len(roles), len(awsRoles))
+	if len(awsRoles) == 0 {
+		return nil
+	}
+
+	awsAccounts, err := parseAWSAccounts(samlAssertion, awsRoles, httpClient)
+	if err != nil {
+		fmt.Fprintf(w, "Unable to resolve the accounts: %v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(tw, "ACCOUNT\tROLE NAME\tROLE ARN\n")
+	for _, awsAccount := range awsAccounts {
+		for _, awsRole := range awsAccount.Roles {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", awsAccount.Name, awsRole.Name, awsRole.RoleARN)
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,100 @@
+package samllogin
+
+import (
+	"encoding/json"
+
+	"gocloak/util/samlHandler/provider/keycloak"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+// The failure boundaries of the AWS login, errors.Is matches a LoginError against its kind
+var (
+	ErrPreflight     = errors.New("IdP or STS endpoint unreachable")
+	ErrBuildProvider = errors.New("error building IdP client")
+	ErrValidateLogin = errors.New("invalid login details")
+	ErrAuthenticate  = errors.New("IdP authentication failed")
+	ErrRoleSelection = errors.New("role selection failed")
+	ErrSTS           = errors.New("STS request failed")
+
+	// ErrInteractionRequired the login needs the user, e.g. to type an MFA token, where nobody can answer
+	ErrInteractionRequired = errors.New("user interaction required")
+)
+
+// The account states the IdP refuses to log in, matched with errors.Is through the ErrAuthenticate LoginError
+var (
+	ErrAccountLocked   = keycloak.ErrAccountLocked
+	ErrAccountDisabled = keycloak.ErrAccountDisabled
+)
+
+// LoginError a failure of one step of the AWS login. Kind is one of the failure boundary sentinels and Err
+// the underlying cause, so errors.Is works for both and errors.As gives access to the step. RequestID is the
+// x-amzn-RequestId of the failed AWS request, if any, which AWS support asks for.
+type LoginError struct {
+	Kind      error
+	Message   string
+	Err       error
+	RequestID string
+}
+
+func (e *LoginError) Error() string {
+	msg := e.Err.Error()
+	if e.Message != "" {
+		msg = e.Message + ": " + msg
+	}
+	if e.RequestID != "" {
+		msg += " (x-amzn-RequestId: " + e.RequestID + ")"
+	}
+
+	return msg
+}
+
+// loginErrorJSON the JSON document of a LoginError
+type loginErrorJSON struct {
+	Kind      string `json:"kind"`
+	Error     string `json:"error"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// MarshalJSON renders the error as an object with its kind, its message and the AWS request ID, if any
+func (e *LoginError) MarshalJSON() ([]byte, error) {
+	doc := loginErrorJSON{Error: e.Error(), RequestID: e.RequestID}
+	if e.Kind != nil {
+		doc.Kind = e.Kind.Error()
+	}
+
+	return json.Marshal(doc)
+}
+
+// Unwrap returns the underlying cause
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error
+func (e *LoginError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newLoginError wraps err as a failure of the kind step with a human readable message
+func newLoginError(kind error, err error, message string) error {
+	return &LoginError{Kind: kind, Message: message, Err: err, RequestID: awsRequestID(err)}
+}
+
+// awsRequestID the request ID of the AWS request err failed on, of either SDK, empty when it isn't an AWS
+// request failure
+func awsRequestID(err error) string {
+	var reqFailure awserr.RequestFailure
+	if errors.As(err, &reqFailure) {
+		return reqFailure.RequestID()
+	}
+
+	// aws-sdk-go-v2 *http.ResponseError
+	var respErr interface{ ServiceRequestID() string }
+	if errors.As(err, &respErr) {
+		return respErr.ServiceRequestID()
+	}
+
+	return ""
+}
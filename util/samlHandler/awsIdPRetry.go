@@ -0,0 +1,95 @@
+package samllogin
+
+import (
+	"context"
+	"net"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+	"gocloak/util/samlHandler/provider"
+
+	"github.com/avast/retry-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultIdPAttempts how many times a transient IdP failure is attempted
+	DefaultIdPAttempts = 3
+
+	// DefaultIdPRetryDelay the base delay of the IdP retry backoff
+	DefaultIdPRetryDelay = time.Duration(1) * time.Second
+)
+
+// retryingSAMLClient retries the calls of the IdP client failing on a transient error
+type retryingSAMLClient struct {
+	client saml2aws.SAMLClient
+	ctx    context.Context
+	opts   *AWSLoginOptions
+}
+
+// withIdPRetry wraps the IdP client so network failures and 5xx responses are retried until ctx is done
+func withIdPRetry(ctx context.Context, client saml2aws.SAMLClient, opts *AWSLoginOptions) saml2aws.SAMLClient {
+	return &retryingSAMLClient{client: client, ctx: ctx, opts: opts}
+}
+
+// Authenticate implements saml2aws.SAMLClient
+func (r *retryingSAMLClient) Authenticate(loginDetails *awscreds.LoginDetails) (string, error) {
+	var samlAssertion string
+	err := r.do(func() error {
+		var err error
+		samlAssertion, err = r.client.Authenticate(loginDetails)
+		return err
+	})
+
+	return samlAssertion, err
+}
+
+// Validate implements saml2aws.SAMLClient
+func (r *retryingSAMLClient) Validate(loginDetails *awscreds.LoginDetails) error {
+	return r.do(func() error {
+		return r.client.Validate(loginDetails)
+	})
+}
+
+func (r *retryingSAMLClient) do(fn func() error) error {
+	attempts := r.opts.IdPAttempts
+	if attempts == 0 {
+		attempts = DefaultIdPAttempts
+	}
+
+	delay := r.opts.IdPRetryDelay
+	if delay == 0 {
+		delay = DefaultIdPRetryDelay
+	}
+
+	return retry.Do(
+		fn,
+		retry.Context(r.ctx),
+		retry.Attempts(attempts),
+		retry.Delay(delay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(isRetryableIdPError),
+		retry.OnRetry(
+			func(n uint, err error) {
+				logger.WithField("attempt", n+1).WithError(err).Warn("IdP request failed, retrying")
+			}),
+	)
+}
+
+// isRetryableIdPError only network failures and 5xx responses are worth retrying, rejected credentials
+// (401/403) or a missing form fail the same way every time
+func isRetryableIdPError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *provider.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,58 @@
+package samllogin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+	"gocloak/util/samlHandler/provider"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakySAMLProvider fails Authenticate with the queued errors, then hands out the assertion
+type flakySAMLProvider struct {
+	fakeSAMLProvider
+	errs  []error
+	calls int
+}
+
+func (f *flakySAMLProvider) Authenticate(loginDetails *awscreds.LoginDetails) (string, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return "", err
+	}
+
+	return f.assertion, nil
+}
+
+func TestIdPRetryRetriesServerErrors(t *testing.T) {
+	flaky := &flakySAMLProvider{
+		fakeSAMLProvider: fakeSAMLProvider{assertion: "assertion"},
+		errs:             []error{errors.Wrap(&provider.StatusError{StatusCode: 503, Status: "503 Service Unavailable"}, "error retrieving form")},
+	}
+
+	client := withIdPRetry(context.Background(), flaky, &AWSLoginOptions{IdPRetryDelay: time.Millisecond})
+
+	samlAssertion, err := client.Authenticate(&awscreds.LoginDetails{})
+	require.Nil(t, err)
+	assert.Equal(t, "assertion", samlAssertion)
+	assert.Equal(t, 2, flaky.calls)
+}
+
+func TestIdPRetryDoesNotRetryRejections(t *testing.T) {
+	flaky := &flakySAMLProvider{
+		errs: []error{errors.Wrap(&provider.StatusError{StatusCode: 401, Status: "401 Unauthorized"}, "error retrieving form")},
+	}
+
+	client := withIdPRetry(context.Background(), flaky, &AWSLoginOptions{IdPRetryDelay: time.Millisecond})
+
+	_, err := client.Authenticate(&awscreds.LoginDetails{})
+	require.NotNil(t, err)
+	assert.Equal(t, 1, flaky.calls)
+}
@@ -0,0 +1,61 @@
+package samllogin
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+
+	"github.com/AlecAivazis/survey/v2/terminal"
+	"golang.org/x/term"
+)
+
+// promptInterruptibly runs the role prompt, aborting it with terminal.InterruptErr on SIGINT or SIGTERM. The
+// terminal is restored to the state it was in beforehand, the prompt may well have left it in raw mode.
+func promptInterruptibly(prompt func() (*saml2aws.AWSRole, error)) (*saml2aws.AWSRole, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		// not a terminal, there is nothing to restore
+		state = nil
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	role, err := awaitPrompt(prompt, interrupts)
+	if err == terminal.InterruptErr && state != nil {
+		if restoreErr := term.Restore(fd, state); restoreErr != nil {
+			logger.WithError(restoreErr).Debug("Unable to restore the terminal.")
+		}
+	}
+
+	return role, err
+}
+
+// awaitPrompt waits for the prompt to answer or for an interrupt, whichever comes first. An interrupted prompt
+// is left blocked on stdin, the login is aborted anyway.
+func awaitPrompt(prompt func() (*saml2aws.AWSRole, error), interrupts <-chan os.Signal) (*saml2aws.AWSRole, error) {
+	type promptResult struct {
+		role *saml2aws.AWSRole
+		err  error
+	}
+
+	done := make(chan promptResult, 1)
+	go func() {
+		role, err := prompt()
+		done <- promptResult{role, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.role, res.err
+	case <-interrupts:
+		// the prompt line was left unfinished
+		fmt.Fprintln(os.Stderr)
+		return nil, terminal.InterruptErr
+	}
+}
@@ -0,0 +1,168 @@
+package samllogin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// loginAllWorkers how many accounts LoginAllAWS logs into at the same time
+const loginAllWorkers = 4
+
+// LoginAllError collects the accounts LoginAllAWS failed to log into, keyed by account name
+type LoginAllError map[string]error
+
+func (e LoginAllError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, e[name]))
+	}
+
+	return fmt.Sprintf("Login failed for %d account(s): %s", len(e), strings.Join(failures, "; "))
+}
+
+// LoginAllAWS authenticates once to the IdP of the first account and reuses the SAML assertion to assume the
+// role of every account, logging into up to loginAllWorkers accounts at a time. Each account goes through the
+// same steps as LoginAWSWithResult: its cached credentials are used when valid, the IdP is only asked when an
+// account has none, and WriteCredentialsFile, the preflight and the timeouts apply. The credentials are keyed by
+// account name (the profile when unnamed). A failing account doesn't abort the others, the credentials
+// obtained are returned along with a LoginAllError listing the failures.
+func LoginAllAWS(ctx context.Context, accounts []*awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (map[string]*awsconfig.AWSCredentials, error) {
+	if len(accounts) == 0 {
+		return nil, errors.New("No accounts to log into.")
+	}
+
+	// roles are resolved concurrently, so there's no prompting
+	workerOpts := AWSLoginOptions{}
+	if opts != nil {
+		workerOpts = *opts
+	}
+	workerOpts.NonInteractive = true
+
+	ctx, cancel := withPhaseTimeout(ctx, workerOpts.LoginTimeout, 0)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		results  = map[string]*awsconfig.AWSCredentials{}
+		failures = LoginAllError{}
+		pending  []*awscfg.IDPAccount
+		jobs     = make(chan *awscfg.IDPAccount)
+	)
+
+	for _, account := range accounts {
+		cachedCreds, err := cachedLoginAWS(account, &workerOpts)
+		if err == nil && cachedCreds == nil {
+			pending = append(pending, account)
+			continue
+		}
+		workerOpts.metrics().IncResult(err == nil)
+
+		if err != nil {
+			failures[accountName(account)] = err
+		} else {
+			results[accountName(account)] = cachedCreds
+		}
+	}
+
+	if len(pending) == 0 {
+		return loginAllResult(results, failures)
+	}
+
+	if workerOpts.Preflight {
+		if err := preflightAWS(ctx, pending[0], loginDetails, &workerOpts); err != nil {
+			return nil, newLoginError(ErrPreflight, err, "")
+		}
+	}
+
+	samlAssertion, err := authenticateAllAWS(ctx, pending[0], loginDetails, &workerOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < loginAllWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for account := range jobs {
+				awsCreds, err := loginAccountAWS(ctx, account, samlAssertion, &workerOpts)
+				workerOpts.metrics().IncResult(err == nil)
+
+				mu.Lock()
+				if err != nil {
+					failures[accountName(account)] = err
+				} else {
+					results[accountName(account)] = awsCreds
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, account := range pending {
+		jobs <- account
+	}
+	close(jobs)
+	wg.Wait()
+
+	return loginAllResult(results, failures)
+}
+
+// loginAllResult the credentials LoginAllAWS obtained, along with the failures if any
+func loginAllResult(results map[string]*awsconfig.AWSCredentials, failures LoginAllError) (map[string]*awsconfig.AWSCredentials, error) {
+	if len(failures) > 0 {
+		return results, failures
+	}
+
+	return results, nil
+}
+
+// authenticateAllAWS the SAML assertion shared by the accounts, bounded by AuthenticateTimeout
+func authenticateAllAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (string, error) {
+	authCtx, cancel := withPhaseTimeout(ctx, opts.AuthenticateTimeout, DefaultAuthenticateTimeout)
+	defer cancel()
+
+	authStart := time.Now()
+	samlAssertion, err := authenticateToIdPAWS(authCtx, account, loginDetails, opts)
+	opts.observePhase(PhaseAuthenticate, authStart)
+
+	return samlAssertion, err
+}
+
+// loginAccountAWS resolves the role of the account from the shared assertion, requests its credentials and
+// saves them into the credentials file when asked to
+func loginAccountAWS(ctx context.Context, account *awscfg.IDPAccount, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	roleStart := time.Now()
+	role, err := selectRoleAWS(samlAssertion, account, opts)
+	opts.observePhase(PhaseRoleResolution, roleStart)
+	if err != nil {
+		return nil, newLoginError(ErrRoleSelection, err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
+	}
+
+	awsCreds, err := requestCredentialsAWS(ctx, account, role, samlAssertion, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeCredentialsFileAWS(account, awsCreds, opts); err != nil {
+		return nil, err
+	}
+
+	return awsCreds, nil
+}
@@ -0,0 +1,52 @@
+package samllogin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginAllAWSUsesTheCache(t *testing.T) {
+	useTempHome(t)
+
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	authentications := 0
+	fake := &fakeSTS{expiration: time.Now().Add(time.Hour)}
+	opts := &AWSLoginOptions{
+		NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			authentications++
+			return &fakeSAMLProvider{assertion: assertion}, nil
+		},
+		STSClient: fake,
+	}
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	admin := newTestIDPAccount()
+	admin.Name = "admin"
+	admin.RoleARN = testAdminRoleARN
+	other := newTestIDPAccount()
+	other.Name = "other"
+	other.RoleARN = testAdminRoleARN
+
+	results, err := LoginAllAWS(context.Background(), []*awscfg.IDPAccount{admin}, loginDetails, opts)
+	require.Nil(t, err)
+	require.Contains(t, results, "admin")
+	require.Equal(t, 1, fake.calls)
+
+	results, err = LoginAllAWS(context.Background(), []*awscfg.IDPAccount{admin, other}, loginDetails, opts)
+	require.Nil(t, err)
+	assert.Len(t, results, 2)
+	require.Equal(t, 2, fake.calls, "the cached account isn't logged into again")
+
+	_, err = LoginAllAWS(context.Background(), []*awscfg.IDPAccount{admin, other}, loginDetails, opts)
+	require.Nil(t, err)
+	assert.Equal(t, 2, fake.calls)
+	assert.Equal(t, 2, authentications, "the IdP isn't asked when every account is cached")
+}
@@ -0,0 +1,43 @@
+package samllogin
+
+import (
+	"os"
+
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// environment variables read by LoginDetailsFromEnv
+const (
+	EnvUsername = "MCLOAK_USERNAME"
+	EnvPassword = "MCLOAK_PASSWORD"
+	EnvMFAToken = "MCLOAK_MFA_TOKEN"
+)
+
+// LoginDetailsFromEnv builds the login details from MCLOAK_USERNAME, MCLOAK_PASSWORD and MCLOAK_MFA_TOKEN,
+// the username and the IdP URL fall back to the account. A password is required.
+func LoginDetailsFromEnv(account *awscfg.IDPAccount) (*awscreds.LoginDetails, error) {
+	loginDetails := &awscreds.LoginDetails{
+		Username: os.Getenv(EnvUsername),
+		Password: os.Getenv(EnvPassword),
+		MFAToken: os.Getenv(EnvMFAToken),
+		URL:      account.URL,
+	}
+
+	if loginDetails.Username == "" {
+		loginDetails.Username = account.Username
+	}
+
+	if loginDetails.Username == "" {
+		return nil, errors.Errorf("No username configured. Set %s or the account username.", EnvUsername)
+	}
+	if loginDetails.Password == "" {
+		return nil, errors.Errorf("No password configured. Set %s.", EnvPassword)
+	}
+
+	logger.WithField("username", loginDetails.Username).Debug("Read login details from the environment.")
+
+	return loginDetails, nil
+}
@@ -0,0 +1,236 @@
+package samllogin
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	// DefaultAuthenticateTimeout how long the IdP authentication may take, MFA included
+	DefaultAuthenticateTimeout = 120 * time.Second
+
+	// DefaultSTSTimeout how long getting the STS credentials may take, retries and role chaining included
+	DefaultSTSTimeout = 30 * time.Second
+)
+
+// AWSLoginOptions tunes the AWS login flow, the zero value keeps the default behaviour
+type AWSLoginOptions struct {
+	// UseSDKv2 requests the STS credentials with aws-sdk-go-v2 instead of aws-sdk-go
+	UseSDKv2 bool
+
+	// RoleFilter is a regular expression, roles whose RoleARN doesn't match are dropped before selection
+	RoleFilter string
+
+	// AllowedRoleARNsFile a file listing the role ARNs that may be assumed, one per line. Lines starting with #
+	// are comments and * or ? act as globs. Roles granted by the IdP but missing from it are never selected.
+	AllowedRoleARNsFile string
+
+	// RoleIndex selects the n-th available role (1-based) instead of prompting, ignored when RoleARN is configured
+	RoleIndex int
+
+	// AutoSelectFirst picks the role with the lowest RoleARN instead of prompting when several are available,
+	// a stable default for scripts. Only applies when neither RoleARN, RoleIndex nor RoleFilter selects one.
+	AutoSelectFirst bool
+
+	// FuzzyRolePrompt narrows the roles of the prompt down with a fuzzy match of what is typed instead of a plain
+	// substring match, handy with hundreds of roles
+	FuzzyRolePrompt bool
+
+	// RoleSelector picks the role when it can't be selected automatically, instead of the terminal prompt.
+	// It gets the accounts sorted by name with their roles sorted by name.
+	RoleSelector func(accounts []*saml2aws.AWSAccount) (*saml2aws.AWSRole, error)
+
+	// NewSAMLProvider builds the IdP client of the account instead of the Keycloak one, MFATokenProvider is then
+	// up to the client
+	NewSAMLProvider func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error)
+
+	// MFATokenProvider collects the MFA token when the IdP asks for one and the login details carry none,
+	// instead of prompting on the terminal. Lets the token come from a device, a TOTP seed or a secrets manager.
+	MFATokenProvider func() (string, error)
+
+	// CredentialStore supplies the IdP password when the login details carry none
+	CredentialStore CredentialStore
+
+	// NonInteractive never prompts for a role, ErrRoleSelectionRequired is returned when none can be picked
+	// automatically. Always on when stdin or stdout isn't a terminal.
+	NonInteractive bool
+
+	// DebugRoles writes the roles of the assertion and the accounts they resolve to on stderr, see DumpRolesAWS
+	DebugRoles bool
+
+	// Reselect prompts for the role even when one was picked for the account before, the new pick is
+	// remembered in its place
+	Reselect bool
+
+	// ForceRefresh skips the credentials cache and always authenticates against the IdP
+	ForceRefresh bool
+
+	// KeepExpiryUTC keeps the Expires of the credentials in UTC, as returned by STS, instead of converting it to
+	// local time. The credential_process, YAML, JSON and environment outputs are in UTC regardless.
+	KeepExpiryUTC bool
+
+	// NoCache neither reads nor writes the credentials cache. The cache only ever serves accounts configuring a
+	// role_arn, any other role is only known once the IdP answered.
+	NoCache bool
+
+	// WriteCredentialsFile saves the credentials into the aws_profile of the account in the shared credentials
+	// file after the login, see WriteToCredentialsFile. Off by default, logins only hand out the credentials
+	// and never touch ~/.aws/credentials. CredentialProcessAWS never writes it.
+	WriteCredentialsFile bool
+
+	// CacheTTL caps how long CredentialProcessAWS hands out the same cached credentials, counted from when they
+	// were issued. By default they are handed out until 15 minutes before they expire.
+	CacheTTL time.Duration
+
+	// ConfigPath the saml2aws configuration file the accounts are loaded from by name, awscfg.DefaultConfigPath
+	// when empty
+	ConfigPath string
+
+	// CacheDir where the credentials are cached, MCLOAK_CACHE_DIR or else mcloak in the user cache directory
+	// when empty. Created with 0700.
+	CacheDir string
+
+	// CacheProfile the AWS profile the credentials are cached for, defaults to AWS_PROFILE. Keeps the caches of
+	// profiles sharing an account apart when running as their credential_process.
+	CacheProfile string
+
+	// STSEndpoint overrides the STS endpoint, by default it's derived from the account region
+	STSEndpoint string
+
+	// Partition the AWS partition (aws, aws-us-gov or aws-cn) the region and role must belong to, it then drives
+	// the STS endpoint. By default the partition is inferred from the region.
+	Partition string
+
+	// SessionPolicy an inline IAM policy (JSON) scoping down the permissions of the SAML session
+	SessionPolicy string
+
+	// SessionPolicyARNs managed policies scoping down the permissions of the SAML session
+	SessionPolicyARNs []string
+
+	// DurationOverride the duration of the session of this login in place of the aws_session_duration of the
+	// account, between 15 minutes and 12 hours. When STS rejects a duration, this one or aws_session_duration,
+	// as above the MaxSessionDuration of the role, the login is retried once with 1 hour, the lowest
+	// MaxSessionDuration, and not with the maximum of the role, which STS doesn't tell.
+	DurationOverride time.Duration
+
+	// RoleRegions the region of the STS session and of the credentials per RoleARN, for roles operating in a
+	// region other than the account region. Roles missing from it use the account region.
+	RoleRegions map[string]string
+
+	// FallbackRegions the regions of the same partition to request the credentials from, in order, when STS is
+	// unreachable or failing in the account region. Ignored when STSEndpoint is set.
+	FallbackRegions []string
+
+	// ChainRoleARN when set, the SAML credentials are used to assume this role and its credentials are returned instead
+	ChainRoleARN string
+
+	// ChainExternalID the external ID to present when assuming ChainRoleARN, required by the trust policy of roles
+	// managed by a third party. 2 to 1224 characters of letters, digits and +=,.@:/-
+	ChainExternalID string
+
+	// RoleSessionName the session name of the chained or web identity role, recorded in CloudTrail. Defaults to
+	// the IdP username of the account. AssumeRoleWithSAML doesn't take one, the SAML session name comes from
+	// the assertion.
+	RoleSessionName string
+
+	// HTTPClient sends the IdP, AWS sign-in and STS requests, e.g. through an authenticated proxy or trusting a
+	// custom CA pool. Only its transport is used for the IdP, which keeps its own cookies. By default the proxy
+	// comes from HTTPS_PROXY and NO_PROXY.
+	HTTPClient *http.Client
+
+	// STSClient exchanges the SAML assertion instead of a client built from the region and STSEndpoint,
+	// ignored with UseSDKv2
+	STSClient STSAPI
+
+	// WebIdentityClient exchanges the OIDC token in LoginAWSWithWebIdentity instead of a client built from the
+	// region and STSEndpoint
+	WebIdentityClient WebIdentityAPI
+
+	// CallerIdentityClient verifies the credentials in VerifyCredentialsWithOptions instead of a client built
+	// from their region and STSEndpoint
+	CallerIdentityClient CallerIdentityAPI
+
+	// Preflight checks the IdP and STS endpoints are reachable before logging in, failing with ErrPreflight
+	// when they aren't
+	Preflight bool
+
+	// CheckClockSkew compares the local clock with the STS endpoint before requesting credentials, warning
+	// beyond a minute of skew and failing with ErrClockSkew beyond five
+	CheckClockSkew bool
+
+	// ClockSkewURL the URL whose Date header is the reference clock of CheckClockSkew, the STS endpoint by default
+	ClockSkewURL string
+
+	// RolePromptAttempts how many invalid answers the role prompt takes before giving up, defaults to
+	// DefaultRolePromptAttempts
+	RolePromptAttempts uint
+
+	// IdPAttempts how many times a network failure or 5xx response of the IdP is attempted, defaults to
+	// DefaultIdPAttempts. Rejected credentials are never retried.
+	IdPAttempts uint
+
+	// IdPRetryDelay the base delay of the exponential IdP retry backoff, defaults to DefaultIdPRetryDelay
+	IdPRetryDelay time.Duration
+
+	// STSAttempts how many times a transient STS failure is attempted, defaults to DefaultSTSAttempts
+	STSAttempts uint
+
+	// STSRetryDelay the base delay of the exponential STS retry backoff, defaults to DefaultSTSRetryDelay
+	STSRetryDelay time.Duration
+
+	// AuthenticateTimeout bounds the IdP authentication, defaults to DefaultAuthenticateTimeout. Negative means no limit.
+	AuthenticateTimeout time.Duration
+
+	// STSTimeout bounds getting the STS credentials, defaults to DefaultSTSTimeout. Negative means no limit.
+	STSTimeout time.Duration
+
+	// LoginTimeout bounds the whole login, role prompt included, on top of the deadline of the context.
+	// By default there is no overall limit.
+	LoginTimeout time.Duration
+
+	// Metrics receives the duration of each login phase and the login outcome
+	Metrics Metrics
+
+	// Clock the time the expiry of the credentials, the freshness of the cache and the validity of the assertion
+	// are judged against, defaults to SystemClock. Timeouts and retries keep running on the system time.
+	Clock Clock
+}
+
+// withPhaseTimeout derives the context of a login phase, timeout falls back to defaultTimeout when unset
+// and a negative one leaves ctx unbounded
+func withPhaseTimeout(ctx context.Context, timeout, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// nonInteractive whether prompting is off, either requested or because there is no terminal to prompt on
+func (opts *AWSLoginOptions) nonInteractive() bool {
+	return opts.NonInteractive || !isTerminal(os.Stdin) || !isTerminal(os.Stdout)
+}
+
+// isTerminal whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+// httpTransport the transport of the client, http.DefaultTransport when it has none
+func httpTransport(client *http.Client) http.RoundTripper {
+	if client.Transport == nil {
+		return http.DefaultTransport
+	}
+
+	return client.Transport
+}
@@ -0,0 +1,376 @@
+package samllogin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/atomicfile"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	ini "gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// WriteToCredentialsFile upserts the credentials into the given profile of the shared aws credentials file,
+// ~/.aws/credentials unless AWS_SHARED_CREDENTIALS_FILE says otherwise. Other profiles are left untouched.
+func WriteToCredentialsFile(awsCreds *awsconfig.AWSCredentials, profile string) error {
+	if profile == "" {
+		return errors.New("profile name required to write the credentials file")
+	}
+
+	sharedCreds := awsconfig.NewSharedCredentials(profile, "")
+
+	err := sharedCreds.Save(awsCreds)
+	if err != nil {
+		return errors.Wrapf(err, "error saving credentials to profile %s", profile)
+	}
+
+	return nil
+}
+
+// WriteRoleProfile upserts a profile into the aws config file, ~/.aws/config unless configPath or AWS_CONFIG_FILE
+// says otherwise, that has the aws cli assume roleARN with the credentials of sourceProfile itself. Other profiles
+// and the other settings of the profile are left untouched.
+func WriteRoleProfile(configPath, profile, roleARN, sourceProfile, region string) error {
+	if profile == "" || roleARN == "" || sourceProfile == "" {
+		return errors.New("profile name, role ARN and source profile required to write the config file")
+	}
+
+	if configPath == "" {
+		configPath = os.Getenv("AWS_CONFIG_FILE")
+	}
+	if configPath == "" {
+		var err error
+		configPath, err = homedir.Expand("~/.aws/config")
+		if err != nil {
+			return errors.Wrap(err, "unable to locate the aws config file")
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(configPath), 0700)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the aws config directory")
+	}
+
+	config, err := ini.LooseLoad(configPath)
+	if err != nil {
+		return errors.Wrapf(err, "unable to load the aws config file %s", configPath)
+	}
+
+	// the config file, unlike the credentials file, prefixes every profile but the default one
+	sectionName := "profile " + profile
+	if profile == "default" {
+		sectionName = profile
+	}
+
+	section := config.Section(sectionName)
+	section.Key("role_arn").SetValue(roleARN)
+	section.Key("source_profile").SetValue(sourceProfile)
+	if region != "" {
+		section.Key("region").SetValue(region)
+	}
+
+	var buf bytes.Buffer
+	_, err = config.WriteTo(&buf)
+	if err != nil {
+		return errors.Wrap(err, "unable to render the aws config file")
+	}
+
+	err = atomicfile.WriteFile(configPath, buf.Bytes(), 0600)
+	if err != nil {
+		return errors.Wrapf(err, "error saving profile %s to %s", profile, configPath)
+	}
+
+	return nil
+}
+
+// credentialProcess the JSON document written by CredentialsToCredentialProcess, Signature is only set by
+// SignCredentialProcess
+type credentialProcess struct {
+	Version         int    `json:"Version"`
+	AccessKeyId     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+	Expiration      string `json:"Expiration"`
+	Signature       string `json:"Signature,omitempty"`
+}
+
+// CredentialsToCredentialProcess returns a JSON output that is compatible with the AWS credential_process
+// https://docs.aws.amazon.com/cli/latest/userguide/cli-configure-sourcing-external.html
+func CredentialsToCredentialProcess(awsCreds *awsconfig.AWSCredentials) (string, error) {
+	return CredentialsToCredentialProcessVersion(awsCreds, DefaultCredentialProcessVersion)
+}
+
+// DefaultCredentialProcessVersion the credential_process format version the AWS CLI and SDKs understand
+const DefaultCredentialProcessVersion = 1
+
+// CredentialsToCredentialProcessVersion returns the credential_process JSON with the given Version, for
+// consumers expecting a format other than DefaultCredentialProcessVersion. The version must be positive.
+func CredentialsToCredentialProcessVersion(awsCreds *awsconfig.AWSCredentials, version int) (string, error) {
+	if version <= 0 {
+		return "", errors.Errorf("invalid credential process version %d, it must be a positive integer", version)
+	}
+
+	credProcess := credentialProcess{
+		Version:         version,
+		AccessKeyId:     awsCreds.AWSAccessKey,
+		SecretAccessKey: awsCreds.AWSSecretKey,
+		SessionToken:    awsCreds.AWSSessionToken,
+		Expiration:      awsCreds.Expires.UTC().Format(time.RFC3339),
+	}
+
+	p, err := json.Marshal(credProcess)
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the credential process")
+	}
+
+	return string(p), nil
+}
+
+// ExpiryFormat how the credential serializers render the expiry, the credential_process JSON is always RFC3339
+// as the AWS CLI and SDKs require
+type ExpiryFormat string
+
+const (
+	// ExpiryRFC3339 the expiry as an RFC3339 timestamp in UTC, the default
+	ExpiryRFC3339 ExpiryFormat = "rfc3339"
+
+	// ExpiryEpoch the expiry as seconds since the Unix epoch
+	ExpiryEpoch ExpiryFormat = "epoch"
+)
+
+// formatExpiry renders the expiry in the first of the formats, RFC3339 when there is none
+func formatExpiry(expires time.Time, formats []ExpiryFormat) string {
+	if len(formats) > 0 && formats[0] == ExpiryEpoch {
+		return strconv.FormatInt(expires.Unix(), 10)
+	}
+
+	return expires.UTC().Format(time.RFC3339)
+}
+
+// credentialsYAML the YAML document written by CredentialsToYAML
+type credentialsYAML struct {
+	AccessKeyID     string      `yaml:"access_key_id"`
+	SecretAccessKey string      `yaml:"secret_access_key"`
+	SessionToken    string      `yaml:"session_token"`
+	Expiration      interface{} `yaml:"expiration"`
+	TTLSeconds      int         `yaml:"ttl_seconds"`
+	Region          string      `yaml:"region"`
+	PrincipalARN    string      `yaml:"principal_arn"`
+}
+
+// CredentialsToYAML returns the credentials as a YAML document with snake_case keys, the expiry in RFC3339
+// unless ExpiryEpoch is given, along with the seconds left until then
+func CredentialsToYAML(awsCreds *awsconfig.AWSCredentials, expiry ...ExpiryFormat) (string, error) {
+	return CredentialsToYAMLAt(awsCreds, SystemClock.Now(), expiry...)
+}
+
+// CredentialsToYAMLAt returns the YAML document of CredentialsToYAML with the seconds left from now
+func CredentialsToYAMLAt(awsCreds *awsconfig.AWSCredentials, now time.Time, expiry ...ExpiryFormat) (string, error) {
+	var expiration interface{} = formatExpiry(awsCreds.Expires, expiry)
+	if len(expiry) > 0 && expiry[0] == ExpiryEpoch {
+		// a number rather than a quoted string
+		expiration = awsCreds.Expires.Unix()
+	}
+
+	credYAML := credentialsYAML{
+		AccessKeyID:     awsCreds.AWSAccessKey,
+		SecretAccessKey: awsCreds.AWSSecretKey,
+		SessionToken:    awsCreds.AWSSessionToken,
+		Expiration:      expiration,
+		TTLSeconds:      int(awsCreds.TTLAt(now).Seconds()),
+		Region:          awsCreds.Region,
+		PrincipalARN:    awsCreds.PrincipalARN,
+	}
+
+	p, err := yaml.Marshal(credYAML)
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the credentials to YAML")
+	}
+
+	return string(p), nil
+}
+
+// terraformCredentials the JSON object written by CredentialsToTerraformJSON
+type terraformCredentials struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Token     string `json:"token"`
+}
+
+// CredentialsToTerraformJSON returns the credentials as the flat JSON object of strings the Terraform external
+// data source expects, with the keys named after the aws provider arguments: access_key, secret_key and token
+func CredentialsToTerraformJSON(awsCreds *awsconfig.AWSCredentials) (string, error) {
+	p, err := json.Marshal(terraformCredentials{
+		AccessKey: awsCreds.AWSAccessKey,
+		SecretKey: awsCreds.AWSSecretKey,
+		Token:     awsCreds.AWSSessionToken,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the credentials for terraform")
+	}
+
+	return string(p), nil
+}
+
+// loginSummary the JSON document written by LoginSummaryJSON
+type loginSummary struct {
+	Account      string `json:"account"`
+	RoleARN      string `json:"roleArn,omitempty"`
+	PrincipalARN string `json:"principalArn"`
+	Expires      string `json:"expires"`
+	Region       string `json:"region"`
+}
+
+// LoginSummaryJSON returns a single JSON object describing the outcome of the login, for wrapper scripts to parse.
+// It holds no secrets. The role ARN is left out when the credentials came from the cache.
+func LoginSummaryJSON(result *LoginResult) (string, error) {
+	if result == nil || result.Credentials == nil {
+		return "", errors.New("no login result to summarize")
+	}
+
+	summary := loginSummary{
+		Account:      saml2aws.ExtractAccountID(result.Credentials.PrincipalARN),
+		PrincipalARN: result.Credentials.PrincipalARN,
+		Expires:      result.Credentials.Expires.UTC().Format(time.RFC3339),
+		Region:       result.Credentials.Region,
+	}
+	if result.Role != nil {
+		summary.RoleARN = result.Role.RoleARN
+		if summary.Account == "" {
+			summary.Account = saml2aws.ExtractAccountID(result.Role.RoleARN)
+		}
+	}
+
+	p, err := json.Marshal(summary)
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the login summary")
+	}
+
+	return string(p), nil
+}
+
+// PrintCredentialProcess prints the credential_process JSON to stdout. Logging goes to stderr,
+// so stdout only ever carries this JSON document for the AWS CLI to parse. When stdout is a terminal
+// it refuses with ErrSecretsToTerminal, see CredentialProcessSink to allow it.
+func PrintCredentialProcess(awsCreds *awsconfig.AWSCredentials) error {
+	return PrintCredentialProcessTo(os.Stdout, awsCreds)
+}
+
+// PrintCredentialProcessTo writes the credential_process JSON to w, e.g. an inherited file descriptor
+// (os.NewFile) or a named pipe, so the credentials reach the other process without touching disk or the shell.
+// It refuses with ErrSecretsToTerminal when w is a terminal.
+func PrintCredentialProcessTo(w io.Writer, awsCreds *awsconfig.AWSCredentials) error {
+	return (&CredentialProcessSink{Writer: w}).Write(awsCreds)
+}
+
+// CredentialsToDockerEnvFile renders the credentials as a docker run --env-file, one unquoted KEY=VALUE per line,
+// the expiry in RFC3339 unless ExpiryEpoch is given
+func CredentialsToDockerEnvFile(awsCreds *awsconfig.AWSCredentials, expiry ...ExpiryFormat) string {
+	lines := []string{
+		"AWS_ACCESS_KEY_ID=" + awsCreds.AWSAccessKey,
+		"AWS_SECRET_ACCESS_KEY=" + awsCreds.AWSSecretKey,
+		"AWS_SESSION_TOKEN=" + awsCreds.AWSSessionToken,
+		"AWS_SESSION_EXPIRATION=" + formatExpiry(awsCreds.Expires, expiry),
+	}
+	if awsCreds.Region != "" {
+		lines = append(lines, "AWS_REGION="+awsCreds.Region)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// CredentialsToDotEnv renders the credentials as a .env file of double quoted KEY="VALUE" lines, as read by
+// direnv or the dotenv loaders, the expiry noted in a comment in RFC3339 unless ExpiryEpoch is given
+func CredentialsToDotEnv(awsCreds *awsconfig.AWSCredentials, expiry ...ExpiryFormat) string {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`)
+
+	vars := [][2]string{
+		{"AWS_ACCESS_KEY_ID", awsCreds.AWSAccessKey},
+		{"AWS_SECRET_ACCESS_KEY", awsCreds.AWSSecretKey},
+		{"AWS_SESSION_TOKEN", awsCreds.AWSSessionToken},
+	}
+	if awsCreds.Region != "" {
+		vars = append(vars, [2]string{"AWS_REGION", awsCreds.Region})
+	}
+
+	lines := []string{"# AWS credentials expiring at " + formatExpiry(awsCreds.Expires, expiry)}
+	for _, v := range vars {
+		lines = append(lines, fmt.Sprintf(`%s="%s"`, v[0], quote.Replace(v[1])))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// credentialFieldNames the fields GetCredentialField knows, in the order they are listed
+var credentialFieldNames = []string{"access-key-id", "secret-access-key", "session-token", "expiration", "region", "principal-arn"}
+
+// GetCredentialField returns a single field of the credentials, one of access-key-id, secret-access-key,
+// session-token, expiration (RFC3339 unless ExpiryEpoch is given), region or principal-arn, for scripts after
+// one value only
+func GetCredentialField(awsCreds *awsconfig.AWSCredentials, field string, expiry ...ExpiryFormat) (string, error) {
+	switch field {
+	case "access-key-id":
+		return awsCreds.AWSAccessKey, nil
+	case "secret-access-key":
+		return awsCreds.AWSSecretKey, nil
+	case "session-token":
+		return awsCreds.AWSSessionToken, nil
+	case "expiration":
+		return formatExpiry(awsCreds.Expires, expiry), nil
+	case "region":
+		return awsCreds.Region, nil
+	case "principal-arn":
+		return awsCreds.PrincipalARN, nil
+	}
+
+	return "", errors.Errorf("unknown credential field %q, expected one of %s", field, strings.Join(credentialFieldNames, ", "))
+}
+
+// CredentialsToEnvVars renders the credentials as environment variable statements for the given shell,
+// one of bash, zsh, fish or powershell, ready to be eval'ed. The expiry is in RFC3339 unless ExpiryEpoch is given.
+func CredentialsToEnvVars(awsCreds *awsconfig.AWSCredentials, shell string, expiry ...ExpiryFormat) (string, error) {
+	var format func(name, value string) string
+
+	switch shell {
+	case "", "bash", "zsh", "sh":
+		format = func(name, value string) string {
+			return fmt.Sprintf("export %s='%s'", name, strings.ReplaceAll(value, "'", `'\''`))
+		}
+	case "fish":
+		format = func(name, value string) string {
+			value = strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value)
+			return fmt.Sprintf("set -gx %s '%s'", name, value)
+		}
+	case "powershell", "pwsh":
+		format = func(name, value string) string {
+			return fmt.Sprintf("$env:%s = '%s'", name, strings.ReplaceAll(value, "'", "''"))
+		}
+	default:
+		return "", errors.Errorf("unsupported shell %q", shell)
+	}
+
+	vars := [][2]string{
+		{"AWS_ACCESS_KEY_ID", awsCreds.AWSAccessKey},
+		{"AWS_SECRET_ACCESS_KEY", awsCreds.AWSSecretKey},
+		{"AWS_SESSION_TOKEN", awsCreds.AWSSessionToken},
+		{"AWS_SESSION_EXPIRATION", formatExpiry(awsCreds.Expires, expiry)},
+	}
+
+	lines := make([]string, 0, len(vars))
+	for _, v := range vars {
+		lines = append(lines, format(v[0], v[1]))
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
@@ -0,0 +1,280 @@
+package samllogin
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+
+	"github.com/aws/aws-sdk-go-v2/credentials/processcreds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ini "gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+var testCreds = &awsconfig.AWSCredentials{
+	AWSAccessKey:     "ASIAEXAMPLE",
+	AWSSecretKey:     "secret/with+chars",
+	AWSSessionToken:  "token/with+chars",
+	AWSSecurityToken: "token/with+chars",
+	PrincipalARN:     "arn:aws:sts::123456789012:assumed-role/Admin/user",
+	Expires:          time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	Region:           "us-east-1",
+}
+
+// captureStdout returns what fn wrote to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+
+	require.Nil(t, w.Close())
+	out, err := io.ReadAll(r)
+	require.Nil(t, err)
+
+	return string(out)
+}
+
+func TestPrintCredentialProcessOnlyWritesJSONToStdout(t *testing.T) {
+	out := captureStdout(t, func() {
+		logger.Info("diagnostic line which must not reach stdout")
+		assert.Nil(t, PrintCredentialProcess(testCreds))
+		logger.Warn("another diagnostic line")
+	})
+
+	dec := json.NewDecoder(bytes.NewBufferString(out))
+
+	var credProcess map[string]interface{}
+	require.Nil(t, dec.Decode(&credProcess))
+	assert.Equal(t, "ASIAEXAMPLE", credProcess["AccessKeyId"])
+
+	// nothing but the single JSON document
+	assert.False(t, dec.More())
+	_, err := dec.Token()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestPrintCredentialProcessToPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+
+	require.Nil(t, PrintCredentialProcessTo(w, testCreds))
+	w.Close()
+
+	out, err := io.ReadAll(r)
+	require.Nil(t, err)
+
+	var credProcess map[string]interface{}
+	require.Nil(t, json.Unmarshal(out, &credProcess))
+	assert.Equal(t, "ASIAEXAMPLE", credProcess["AccessKeyId"])
+}
+
+func TestCredentialsToCredentialProcessMatchesSDKShape(t *testing.T) {
+	out, err := CredentialsToCredentialProcess(testCreds)
+	require.Nil(t, err)
+
+	var resp processcreds.CredentialProcessResponse
+	require.Nil(t, json.Unmarshal([]byte(out), &resp))
+
+	assert.Equal(t, 1, resp.Version)
+	assert.Equal(t, testCreds.AWSAccessKey, resp.AccessKeyID)
+	assert.Equal(t, testCreds.AWSSecretKey, resp.SecretAccessKey)
+	assert.Equal(t, testCreds.AWSSessionToken, resp.SessionToken)
+	require.NotNil(t, resp.Expiration)
+	assert.True(t, testCreds.Expires.Equal(*resp.Expiration))
+
+	var keys map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(out), &keys))
+	for _, key := range []string{"Version", "AccessKeyId", "SecretAccessKey", "SessionToken", "Expiration"} {
+		assert.Contains(t, keys, key)
+	}
+}
+
+func TestCredentialsToYAMLRoundTrip(t *testing.T) {
+	out, err := CredentialsToYAML(testCreds)
+	require.Nil(t, err)
+
+	var parsed credentialsYAML
+	require.Nil(t, yaml.Unmarshal([]byte(out), &parsed))
+
+	assert.Equal(t, testCreds.AWSAccessKey, parsed.AccessKeyID)
+	assert.Equal(t, testCreds.AWSSecretKey, parsed.SecretAccessKey)
+	assert.Equal(t, testCreds.AWSSessionToken, parsed.SessionToken)
+	assert.Equal(t, testCreds.Region, parsed.Region)
+	assert.Equal(t, testCreds.PrincipalARN, parsed.PrincipalARN)
+
+	expiration, ok := parsed.Expiration.(string)
+	require.True(t, ok, "the expiration is a string by default")
+	expires, err := time.Parse(time.RFC3339, expiration)
+	require.Nil(t, err)
+	assert.True(t, testCreds.Expires.Equal(expires))
+	assert.Equal(t, 0, parsed.TTLSeconds, "expired credentials have no TTL left")
+
+	assert.Contains(t, out, "access_key_id: ")
+	assert.Contains(t, out, "expiration: \"2024-01-02T03:04:05Z\"")
+}
+
+func TestLoginSummaryJSONHasNoSecrets(t *testing.T) {
+	result := &LoginResult{
+		Credentials: testCreds,
+		Role:        &saml2aws.AWSRole{RoleARN: testAdminRoleARN, PrincipalARN: testPrincipalARN},
+	}
+
+	out, err := LoginSummaryJSON(result)
+	require.Nil(t, err)
+
+	var parsed map[string]string
+	require.Nil(t, json.Unmarshal([]byte(out), &parsed))
+
+	assert.Equal(t, map[string]string{
+		"account":      "123456789012",
+		"roleArn":      testAdminRoleARN,
+		"principalArn": testCreds.PrincipalARN,
+		"expires":      "2024-01-02T03:04:05Z",
+		"region":       "us-east-1",
+	}, parsed)
+	assert.NotContains(t, out, testCreds.AWSSecretKey)
+	assert.NotContains(t, out, testCreds.AWSSessionToken)
+}
+
+func TestWriteRoleProfileKeepsOtherProfiles(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), ".aws", "config")
+	require.Nil(t, os.MkdirAll(filepath.Dir(configPath), 0700))
+	require.Nil(t, os.WriteFile(configPath, []byte("[default]\nregion = eu-west-1\n\n[profile admin]\noutput = json\n"), 0600))
+
+	require.Nil(t, WriteRoleProfile(configPath, "admin", testAdminRoleARN, "saml", "us-east-1"))
+
+	config, err := ini.Load(configPath)
+	require.Nil(t, err)
+
+	assert.Equal(t, "eu-west-1", config.Section("default").Key("region").String())
+
+	admin := config.Section("profile admin")
+	assert.Equal(t, "json", admin.Key("output").String())
+	assert.Equal(t, testAdminRoleARN, admin.Key("role_arn").String())
+	assert.Equal(t, "saml", admin.Key("source_profile").String())
+	assert.Equal(t, "us-east-1", admin.Key("region").String())
+}
+
+func TestCredentialsToTerraformJSONRoundTrip(t *testing.T) {
+	out, err := CredentialsToTerraformJSON(testCreds)
+	require.Nil(t, err)
+
+	// the external data source only takes a flat object of strings
+	var parsed map[string]string
+	require.Nil(t, json.Unmarshal([]byte(out), &parsed))
+
+	assert.Equal(t, map[string]string{
+		"access_key": testCreds.AWSAccessKey,
+		"secret_key": testCreds.AWSSecretKey,
+		"token":      testCreds.AWSSessionToken,
+	}, parsed)
+}
+
+func TestCredentialsToCredentialProcessExpirationInUTC(t *testing.T) {
+	local := *testCreds
+	local.Expires = testCreds.Expires.In(time.FixedZone("CEST", 2*60*60))
+
+	out, err := CredentialsToCredentialProcess(&local)
+	require.Nil(t, err)
+	assert.Contains(t, out, `"Expiration":"2024-01-02T03:04:05Z"`)
+}
+
+func TestCredentialsToCredentialProcessVersion(t *testing.T) {
+	out, err := CredentialsToCredentialProcessVersion(testCreds, 2)
+	require.Nil(t, err)
+
+	var credProcess map[string]interface{}
+	require.Nil(t, json.Unmarshal([]byte(out), &credProcess))
+	assert.Equal(t, float64(2), credProcess["Version"])
+
+	_, err = CredentialsToCredentialProcessVersion(testCreds, 0)
+	assert.NotNil(t, err)
+}
+
+func TestCredentialsToDotEnv(t *testing.T) {
+	out := CredentialsToDotEnv(testCreds)
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	require.Len(t, lines, 5)
+	assert.True(t, strings.HasPrefix(lines[0], "# "))
+	assert.Contains(t, lines[0], testCreds.Expires.UTC().Format(time.RFC3339))
+	assert.Equal(t, `AWS_ACCESS_KEY_ID="ASIAEXAMPLE"`, lines[1])
+	assert.Equal(t, `AWS_SECRET_ACCESS_KEY="secret/with+chars"`, lines[2])
+	assert.Equal(t, `AWS_REGION="`+testCreds.Region+`"`, lines[4])
+
+	quoted := CredentialsToDotEnv(&awsconfig.AWSCredentials{AWSSecretKey: `a"b$c\d`})
+	assert.Contains(t, quoted, `AWS_SECRET_ACCESS_KEY="a\"b\$c\\d"`)
+	assert.NotContains(t, quoted, "AWS_REGION")
+}
+
+func TestGetCredentialField(t *testing.T) {
+	for field, want := range map[string]string{
+		"access-key-id":     "ASIAEXAMPLE",
+		"secret-access-key": "secret/with+chars",
+		"session-token":     "token/with+chars",
+		"expiration":        "2024-01-02T03:04:05Z",
+		"region":            "us-east-1",
+		"principal-arn":     "arn:aws:sts::123456789012:assumed-role/Admin/user",
+	} {
+		got, err := GetCredentialField(testCreds, field)
+		require.Nil(t, err, field)
+		assert.Equal(t, want, got, field)
+	}
+
+	_, err := GetCredentialField(testCreds, "password")
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "access-key-id")
+}
+
+func TestExpiryFormats(t *testing.T) {
+	rfc3339 := "2024-01-02T03:04:05Z"
+	epoch := "1704164645"
+
+	expiration, err := GetCredentialField(testCreds, "expiration")
+	require.Nil(t, err)
+	assert.Equal(t, rfc3339, expiration)
+	expiration, err = GetCredentialField(testCreds, "expiration", ExpiryEpoch)
+	require.Nil(t, err)
+	assert.Equal(t, epoch, expiration)
+
+	assert.Contains(t, CredentialsToDockerEnvFile(testCreds), "AWS_SESSION_EXPIRATION="+rfc3339+"\n")
+	assert.Contains(t, CredentialsToDockerEnvFile(testCreds, ExpiryEpoch), "AWS_SESSION_EXPIRATION="+epoch+"\n")
+
+	envVars, err := CredentialsToEnvVars(testCreds, "bash", ExpiryEpoch)
+	require.Nil(t, err)
+	assert.Contains(t, envVars, "export AWS_SESSION_EXPIRATION='"+epoch+"'")
+
+	out, err := CredentialsToYAML(testCreds, ExpiryEpoch)
+	require.Nil(t, err)
+	var parsed map[string]interface{}
+	require.Nil(t, yaml.Unmarshal([]byte(out), &parsed))
+	assert.Equal(t, 1704164645, parsed["expiration"])
+
+	out, err = CredentialsToYAML(testCreds)
+	require.Nil(t, err)
+	require.Nil(t, yaml.Unmarshal([]byte(out), &parsed))
+	assert.Equal(t, rfc3339, parsed["expiration"])
+}
+
+func TestCredentialsToYAMLAtCountsTTLFromNow(t *testing.T) {
+	out, err := CredentialsToYAMLAt(testCreds, testCreds.Expires.Add(-90*time.Minute))
+	require.Nil(t, err)
+
+	var parsed credentialsYAML
+	require.Nil(t, yaml.Unmarshal([]byte(out), &parsed))
+	assert.Equal(t, 5400, parsed.TTLSeconds)
+}
@@ -0,0 +1,67 @@
+package samllogin
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+)
+
+// preflightTimeout how long each endpoint is given to answer the preflight check
+const preflightTimeout = 5 * time.Second
+
+// preflightAWS checks the IdP and STS endpoints answer at all, so network, DNS and proxy problems are reported
+// as such rather than as a failure deep in the login. Any HTTP response counts as reachable.
+func preflightAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) error {
+	idpURL := account.URL
+	if loginDetails != nil && loginDetails.URL != "" {
+		idpURL = loginDetails.URL
+	}
+
+	if err := checkReachable(ctx, opts.HTTPClient, idpURL); err != nil {
+		return errors.Wrapf(err, "Cannot reach IdP at %s.", idpURL)
+	}
+
+	region, err := resolveRegion(account.Region)
+	if err != nil {
+		// the region may yet come from the destination of the assertion
+		logger.WithError(err).Debug("Skipping the STS preflight check.")
+		return nil
+	}
+
+	stsURL := stsEndpointURL(region, opts)
+	if err := checkReachable(ctx, opts.HTTPClient, stsURL); err != nil {
+		return errors.Wrapf(err, "Cannot reach STS at %s.", stsURL)
+	}
+
+	logger.Debug("IdP and STS endpoints are reachable.")
+
+	return nil
+}
+
+// checkReachable whether url answers a HEAD request, whatever the status
+func checkReachable(ctx context.Context, httpClient *http.Client, url string) error {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "error building preflight request")
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
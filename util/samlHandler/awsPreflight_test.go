@@ -0,0 +1,53 @@
+package samllogin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflightAWS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(server.Close)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	account := newTestIDPAccount()
+
+	t.Run("reachable", func(t *testing.T) {
+		opts := &AWSLoginOptions{STSEndpoint: server.URL}
+		assert.Nil(t, preflightAWS(context.Background(), account, &awscreds.LoginDetails{URL: server.URL}, opts))
+	})
+
+	t.Run("IdP unreachable", func(t *testing.T) {
+		opts := &AWSLoginOptions{STSEndpoint: server.URL}
+		err := preflightAWS(context.Background(), account, &awscreds.LoginDetails{URL: down.URL}, opts)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Cannot reach IdP at "+down.URL)
+	})
+
+	t.Run("STS unreachable", func(t *testing.T) {
+		opts := &AWSLoginOptions{STSEndpoint: down.URL}
+		err := preflightAWS(context.Background(), account, &awscreds.LoginDetails{URL: server.URL}, opts)
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "Cannot reach STS at "+down.URL)
+	})
+
+	t.Run("login fails with ErrPreflight", func(t *testing.T) {
+		useTempHome(t)
+
+		opts := &AWSLoginOptions{Preflight: true, STSEndpoint: server.URL}
+		_, err := LoginAWSWithResult(context.Background(), account, &awscreds.LoginDetails{URL: down.URL, Username: "alice"}, opts)
+		assert.True(t, errors.Is(err, ErrPreflight))
+	})
+}
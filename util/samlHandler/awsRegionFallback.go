@@ -0,0 +1,96 @@
+package samllogin
+
+import (
+	"context"
+	"net"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// loginToStsWithFallbackAWS requests the credentials from STS in the region of the account, then in the
+// FallbackRegions of the same partition one after the other for as long as STS is unreachable or failing
+func loginToStsWithFallbackAWS(ctx context.Context, account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	awsCreds, err := loginToStsAWS(ctx, account, role, samlAssertion, opts)
+	if err == nil || len(opts.FallbackRegions) == 0 || opts.STSEndpoint != "" {
+		return awsCreds, err
+	}
+
+	primary, regionErr := resolveRegion(account.Region)
+	if regionErr != nil {
+		return nil, err
+	}
+
+	for _, region := range opts.FallbackRegions {
+		if ctx.Err() != nil || !isSTSUnavailableError(err) {
+			break
+		}
+		if region == primary {
+			continue
+		}
+		if !samePartition(primary, region) {
+			logger.WithField("region", region).Warn("Skipping STS fallback region of another partition.")
+			continue
+		}
+
+		logger.WithError(err).WithField("region", region).Warn("STS unavailable, falling back to another region.")
+
+		regionAccount := *account
+		regionAccount.Region = region
+		awsCreds, err = loginToStsAWS(ctx, &regionAccount, role, samlAssertion, opts)
+		if err == nil {
+			return awsCreds, nil
+		}
+	}
+
+	return nil, err
+}
+
+// loginToStsAWS requests the credentials with the SDK the options pick
+func loginToStsAWS(ctx context.Context, account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if opts.UseSDKv2 {
+		return loginToStsUsingRoleV2(ctx, account, role, samlAssertion, opts)
+	}
+
+	return loginToStsUsingRoleALIAWS(ctx, account, role, samlAssertion, opts)
+}
+
+// isSTSUnavailableError only connectivity failures and 5xx responses say anything about the region, access
+// denied or an expired assertion would fail the same way anywhere
+func isSTSUnavailableError(err error) bool {
+	var reqFailure awserr.RequestFailure
+	if errors.As(err, &reqFailure) {
+		return reqFailure.StatusCode() >= 500
+	}
+
+	// aws-sdk-go-v2 responses
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		return statusErr.HTTPStatusCode() >= 500
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == request.ErrCodeRequestError {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// samePartition whether both regions belong to the same AWS partition
+func samePartition(region, other string) bool {
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return false
+	}
+	otherPartition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), other)
+
+	return ok && partition.ID() == otherPartition.ID()
+}
@@ -0,0 +1,46 @@
+package samllogin
+
+import (
+	"context"
+	"testing"
+
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginToStsWithFallbackAWS(t *testing.T) {
+	unavailable := awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Service unavailable", nil), 503, "req")
+	account := &awscfg.IDPAccount{Region: "us-east-1", SessionDuration: 3600}
+
+	t.Run("falls back on a 5xx", func(t *testing.T) {
+		fake := &fakeSTS{errs: []error{unavailable}}
+		opts := &AWSLoginOptions{STSClient: fake, STSAttempts: 1, FallbackRegions: []string{"us-east-1", "eu-west-1"}}
+
+		awsCreds, err := loginToStsWithFallbackAWS(context.Background(), account, testRole, "assertion", opts)
+		require.Nil(t, err)
+		assert.Equal(t, 2, fake.calls)
+		assert.Equal(t, "eu-west-1", awsCreds.Region)
+	})
+
+	t.Run("skips regions of another partition", func(t *testing.T) {
+		fake := &fakeSTS{errs: []error{unavailable}}
+		opts := &AWSLoginOptions{STSClient: fake, STSAttempts: 1, FallbackRegions: []string{"cn-north-1"}}
+
+		_, err := loginToStsWithFallbackAWS(context.Background(), account, testRole, "assertion", opts)
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, fake.calls)
+	})
+
+	t.Run("never falls back on access denied", func(t *testing.T) {
+		denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized", nil), 403, "req")
+		fake := &fakeSTS{errs: []error{denied}}
+		opts := &AWSLoginOptions{STSClient: fake, STSAttempts: 1, FallbackRegions: []string{"eu-west-1"}}
+
+		_, err := loginToStsWithFallbackAWS(context.Background(), account, testRole, "assertion", opts)
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, fake.calls)
+	})
+}
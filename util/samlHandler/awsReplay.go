@@ -0,0 +1,37 @@
+package samllogin
+
+import (
+	"context"
+	"strings"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+)
+
+// LoginAWSWithAssertion replays a captured SAML assertion: the IdP is skipped and the base64 encoded
+// assertion goes through role selection and STS as if the IdP had just sent it. This is a debugging aid
+// to reproduce role selection problems from a sanitized assertion, not a login path. The credentials
+// cache is neither read nor written.
+func LoginAWSWithAssertion(account *awscfg.IDPAccount, assertionB64 string) (*awsconfig.AWSCredentials, error) {
+	return LoginAWSWithAssertionAndOptions(context.Background(), account, assertionB64, nil)
+}
+
+// LoginAWSWithAssertionAndOptions runs LoginAWSWithAssertion tuned by opts, a nil opts behaves like LoginAWSWithAssertion
+func LoginAWSWithAssertionAndOptions(ctx context.Context, account *awscfg.IDPAccount, assertionB64 string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	replayOpts := AWSLoginOptions{}
+	if opts != nil {
+		replayOpts = *opts
+	}
+	replayOpts.NoCache = true
+
+	logger.Warn("Replaying a provided SAML assertion, the IdP is skipped. This is meant for debugging only.")
+
+	samlAssertion := strings.Join(strings.Fields(assertionB64), "")
+
+	role, err := selectRoleAWS(samlAssertion, account, &replayOpts)
+	if err != nil {
+		return nil, newLoginError(ErrRoleSelection, err, "Failed to select a role from the provided SAML assertion.")
+	}
+
+	return requestCredentialsAWS(ctx, account, role, samlAssertion, &replayOpts)
+}
@@ -0,0 +1,126 @@
+package samllogin
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/atomicfile"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+// roleSelectionsFile where the roles picked at the prompt are remembered, keyed by account name
+const roleSelectionsFile = "~/.mcloak/selections.json"
+
+// loadRoleSelections returns the remembered RoleARN of every account
+func loadRoleSelections() (map[string]string, error) {
+	filename, err := homedir.Expand(roleSelectionsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to locate the role selections file")
+	}
+
+	selections := map[string]string{}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return selections, nil
+		}
+		return nil, errors.Wrapf(err, "unable to read role selections %s", filename)
+	}
+
+	err = json.Unmarshal(data, &selections)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse role selections %s", filename)
+	}
+
+	return selections, nil
+}
+
+// rememberedRoleAWS returns the role last picked at the prompt for the account, nil when none was or it is no
+// longer one of the awsAccounts roles
+func rememberedRoleAWS(account *awscfg.IDPAccount, awsAccounts []*saml2aws.AWSAccount) *saml2aws.AWSRole {
+	name := accountName(account)
+	if name == "" {
+		return nil
+	}
+
+	selections, err := loadRoleSelections()
+	if err != nil {
+		logger.WithError(err).Warn("Unable to load the remembered role selections.")
+		return nil
+	}
+
+	roleARN, ok := selections[name]
+	if !ok {
+		return nil
+	}
+
+	for _, awsRole := range saml2aws.AccountRoles(awsAccounts) {
+		if awsRole.RoleARN == roleARN {
+			return awsRole
+		}
+	}
+
+	return nil
+}
+
+// saveRoleSelection remembers roleARN as the role picked for the account
+func saveRoleSelection(account *awscfg.IDPAccount, roleARN string) error {
+	name := accountName(account)
+	if name == "" {
+		return nil
+	}
+
+	selections, err := loadRoleSelections()
+	if err != nil {
+		return err
+	}
+	selections[name] = roleARN
+
+	return saveRoleSelections(selections)
+}
+
+// forgetRoleSelection drops the role remembered for the account name, if any
+func forgetRoleSelection(name string) error {
+	selections, err := loadRoleSelections()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := selections[name]; !ok {
+		return nil
+	}
+	delete(selections, name)
+
+	return saveRoleSelections(selections)
+}
+
+// saveRoleSelections writes the remembered RoleARN of every account
+func saveRoleSelections(selections map[string]string) error {
+	filename, err := homedir.Expand(roleSelectionsFile)
+	if err != nil {
+		return errors.Wrap(err, "unable to locate the role selections file")
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return errors.Wrap(err, "unable to create the role selections directory")
+	}
+
+	data, err := json.Marshal(selections)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal role selections")
+	}
+
+	err = atomicfile.WriteFile(filename, data, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "unable to write role selections %s", filename)
+	}
+
+	return nil
+}
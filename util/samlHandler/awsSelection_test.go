@@ -0,0 +1,62 @@
+package samllogin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveRoleRemembersSelection(t *testing.T) {
+	useTempHome(t)
+	server := newAWSSigninServer(t)
+	assertion := buildAssertion(server.URL, roleAttribute(testAdminRoleARN, testReadRoleARN))
+
+	awsRoles, err := extractAWSRoles(assertion)
+	require.Nil(t, err)
+
+	fake := &fakePrompter{}
+	usePrompter(t, fake)
+
+	accounts := []*saml2aws.AWSAccount{
+		{Name: "Account: prod (123456789012)", Roles: []*saml2aws.AWSRole{{RoleARN: testAdminRoleARN, Name: "Admin"}}},
+	}
+	role, err := promptAndRememberRoleAWS(newTestIDPAccount(), accounts, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.Equal(t, testAdminRoleARN, role.RoleARN)
+
+	info, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".mcloak", "selections.json"))
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	t.Run("selects the remembered role without prompting", func(t *testing.T) {
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{NonInteractive: true})
+		require.Nil(t, err)
+		assert.Equal(t, testAdminRoleARN, role.RoleARN)
+		assert.Equal(t, testPrincipalARN, role.PrincipalARN)
+		assert.Equal(t, 1, fake.calls)
+	})
+
+	t.Run("reselect ignores the remembered role", func(t *testing.T) {
+		_, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{Reselect: true, NonInteractive: true})
+		assert.Equal(t, ErrRoleSelectionRequired, err)
+	})
+
+	t.Run("other accounts are not affected", func(t *testing.T) {
+		account := newTestIDPAccount()
+		account.Name = "other"
+		_, err := resolveRoleALIAWS(awsRoles, assertion, account, &AWSLoginOptions{NonInteractive: true})
+		assert.Equal(t, ErrRoleSelectionRequired, err)
+	})
+
+	t.Run("ignores a remembered role no longer available", func(t *testing.T) {
+		require.Nil(t, saveRoleSelection(newTestIDPAccount(), "arn:aws:iam::123456789012:role/Gone"))
+
+		_, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{NonInteractive: true})
+		assert.Equal(t, ErrRoleSelectionRequired, err)
+	})
+}
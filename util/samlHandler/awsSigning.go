@@ -0,0 +1,101 @@
+package samllogin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+
+	"github.com/pkg/errors"
+)
+
+// ErrSignatureMismatch is returned when the signature of a credential_process JSON doesn't match its content,
+// it was tampered with or signed with another key
+var ErrSignatureMismatch = errors.New("credential process signature mismatch")
+
+// SignCredentialProcess adds a Signature to the credential_process JSON, the base64 HMAC-SHA256 of the JSON
+// without it under the shared key, for the consumer to check with VerifyCredentialProcess. The AWS CLI and
+// SDKs ignore the extra field.
+func SignCredentialProcess(credentialProcessJSON string, key []byte) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("signing key required to sign the credential process")
+	}
+
+	var credProcess credentialProcess
+	if err := json.Unmarshal([]byte(credentialProcessJSON), &credProcess); err != nil {
+		return "", errors.Wrap(err, "error while parsing the credential process")
+	}
+
+	signature, err := credentialProcessSignature(credProcess, key)
+	if err != nil {
+		return "", err
+	}
+	credProcess.Signature = signature
+
+	p, err := json.Marshal(credProcess)
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the credential process")
+	}
+
+	return string(p), nil
+}
+
+// VerifyCredentialProcess checks the Signature of a credential_process JSON signed with SignCredentialProcess
+// and returns its credentials, ErrSignatureMismatch when it doesn't match
+func VerifyCredentialProcess(signedJSON string, key []byte) (*awsconfig.AWSCredentials, error) {
+	if len(key) == 0 {
+		return nil, errors.New("signing key required to verify the credential process")
+	}
+
+	var credProcess credentialProcess
+	if err := json.Unmarshal([]byte(signedJSON), &credProcess); err != nil {
+		return nil, errors.Wrap(err, "error while parsing the credential process")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(credProcess.Signature)
+	if err != nil || len(signature) == 0 {
+		return nil, errors.Wrap(ErrSignatureMismatch, "missing or malformed signature")
+	}
+
+	expected, err := credentialProcessSignature(credProcess, key)
+	if err != nil {
+		return nil, err
+	}
+	expectedSignature, _ := base64.StdEncoding.DecodeString(expected)
+
+	if !hmac.Equal(signature, expectedSignature) {
+		return nil, ErrSignatureMismatch
+	}
+
+	expires, err := time.Parse(time.RFC3339, credProcess.Expiration)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while parsing the credential process expiration")
+	}
+
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     credProcess.AccessKeyId,
+		AWSSecretKey:     credProcess.SecretAccessKey,
+		AWSSessionToken:  credProcess.SessionToken,
+		AWSSecurityToken: credProcess.SessionToken,
+		Expires:          expires,
+	}, nil
+}
+
+// credentialProcessSignature the base64 HMAC-SHA256 of the credential process JSON without its signature, the
+// fields marshalled in their struct order so signer and verifier agree on the bytes
+func credentialProcessSignature(credProcess credentialProcess, key []byte) (string, error) {
+	credProcess.Signature = ""
+
+	p, err := json.Marshal(credProcess)
+	if err != nil {
+		return "", errors.Wrap(err, "error while marshalling the credential process")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(p)
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,39 @@
+package samllogin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerifyCredentialProcess(t *testing.T) {
+	key := []byte("shared-key")
+
+	var buf bytes.Buffer
+	require.Nil(t, (&CredentialProcessSink{Writer: &buf, SigningKey: key}).Write(testCreds))
+	signed := strings.TrimSpace(buf.String())
+	assert.Contains(t, signed, `"Signature":"`)
+
+	awsCreds, err := VerifyCredentialProcess(signed, key)
+	require.Nil(t, err)
+	assert.Equal(t, testCreds.AWSAccessKey, awsCreds.AWSAccessKey)
+	assert.Equal(t, testCreds.AWSSecretKey, awsCreds.AWSSecretKey)
+	assert.Equal(t, testCreds.AWSSessionToken, awsCreds.AWSSessionToken)
+	assert.True(t, testCreds.Expires.Equal(awsCreds.Expires))
+
+	_, err = VerifyCredentialProcess(signed, []byte("other-key"))
+	assert.True(t, errors.Is(err, ErrSignatureMismatch))
+
+	tampered := strings.Replace(signed, testCreds.AWSAccessKey, "ASIATAMPERED", 1)
+	_, err = VerifyCredentialProcess(tampered, key)
+	assert.True(t, errors.Is(err, ErrSignatureMismatch))
+
+	unsigned, err := CredentialsToCredentialProcess(testCreds)
+	require.Nil(t, err)
+	_, err = VerifyCredentialProcess(unsigned, key)
+	assert.True(t, errors.Is(err, ErrSignatureMismatch))
+}
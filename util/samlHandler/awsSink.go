@@ -0,0 +1,101 @@
+package samllogin
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialSink receives the credentials of a login, so callers choose where they end up
+type CredentialSink interface {
+	Write(awsCreds *awsconfig.AWSCredentials) error
+}
+
+// ErrSecretsToTerminal is returned instead of printing the credentials on a terminal, where they'd end up
+// in the scrollback
+var ErrSecretsToTerminal = errors.New("refusing to print credentials on a terminal")
+
+// CredentialProcessSink writes the credential_process JSON to Writer, os.Stdout when nil. It refuses with
+// ErrSecretsToTerminal when that is a terminal, unless AllowInteractiveSecretPrint is set. Version defaults
+// to DefaultCredentialProcessVersion. With a SigningKey the JSON is signed, see SignCredentialProcess.
+type CredentialProcessSink struct {
+	Writer                      io.Writer
+	AllowInteractiveSecretPrint bool
+	Version                     int
+	SigningKey                  []byte
+}
+
+// Write implements CredentialSink
+func (s *CredentialProcessSink) Write(awsCreds *awsconfig.AWSCredentials) error {
+	if !s.AllowInteractiveSecretPrint && isTerminalWriter(writerOrStdout(s.Writer)) {
+		logger.Warn("Not printing the credentials on a terminal, the AWS CLI is meant to run this as credential_process.")
+		return ErrSecretsToTerminal
+	}
+
+	version := s.Version
+	if version == 0 {
+		version = DefaultCredentialProcessVersion
+	}
+
+	jsonData, err := CredentialsToCredentialProcessVersion(awsCreds, version)
+	if err != nil {
+		return err
+	}
+
+	if len(s.SigningKey) > 0 {
+		jsonData, err = SignCredentialProcess(jsonData, s.SigningKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintln(writerOrStdout(s.Writer), jsonData)
+	return err
+}
+
+// SharedCredentialsSink saves the credentials into Profile of the shared credentials file
+type SharedCredentialsSink struct {
+	Profile string
+}
+
+// Write implements CredentialSink
+func (s *SharedCredentialsSink) Write(awsCreds *awsconfig.AWSCredentials) error {
+	return WriteToCredentialsFile(awsCreds, s.Profile)
+}
+
+// EnvVarsSink writes the credentials as environment variable statements for Shell to Writer, os.Stdout when nil,
+// the expiry in ExpiryFormat, RFC3339 when empty
+type EnvVarsSink struct {
+	Writer       io.Writer
+	Shell        string
+	ExpiryFormat ExpiryFormat
+}
+
+// Write implements CredentialSink
+func (s *EnvVarsSink) Write(awsCreds *awsconfig.AWSCredentials) error {
+	envVars, err := CredentialsToEnvVars(awsCreds, s.Shell, s.ExpiryFormat)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(writerOrStdout(s.Writer), envVars)
+	return err
+}
+
+// isTerminalWriter whether w is a file attached to a terminal
+func isTerminalWriter(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && isTerminal(f)
+}
+
+func writerOrStdout(w io.Writer) io.Writer {
+	if w == nil {
+		return os.Stdout
+	}
+
+	return w
+}
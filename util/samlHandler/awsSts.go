@@ -0,0 +1,544 @@
+package samllogin
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	"gocloak/util/samlHandler/redact"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/avast/retry-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultSTSAttempts how many times a transient STS failure is attempted
+	DefaultSTSAttempts = 3
+
+	// DefaultSTSRetryDelay the base delay of the STS retry backoff
+	DefaultSTSRetryDelay = time.Duration(1) * time.Second
+
+	// minSessionDuration the shortest session STS hands out
+	minSessionDuration = 900
+
+	// maxSessionDuration the longest session STS hands out, provided the role MaxSessionDuration allows it
+	maxSessionDuration = 43200
+
+	// minMaxSessionDuration the lowest MaxSessionDuration a role can have, so always accepted by STS
+	minMaxSessionDuration = 3600
+
+	// maxChainedSessionDuration AWS caps role chaining sessions at one hour
+	maxChainedSessionDuration = 3600
+
+	// minExternalIDLength and maxExternalIDLength the lengths of external ID STS accepts
+	minExternalIDLength = 2
+	maxExternalIDLength = 1224
+
+	// defaultRoleSessionName the session name of the chained or web identity role when no username is known
+	defaultRoleSessionName = "mcloak"
+
+	// sessionCapTolerance how much shorter than requested a session may be before it is reported as capped,
+	// covers the clock skew and the time spent getting the credentials
+	sessionCapTolerance = 5 * time.Minute
+
+	// maxRoleSessionNameLength the longest session name STS accepts
+	maxRoleSessionNameLength = 64
+)
+
+// roleSessionNameFormat the session names STS accepts
+var roleSessionNameFormat = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+// roleSessionNameInvalidChars what STS refuses in a session name
+var roleSessionNameInvalidChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// externalIDFormat the characters STS accepts in an external ID, of minExternalIDLength to maxExternalIDLength
+var externalIDFormat = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+
+// regionFormat what an AWS region looks like, e.g. eu-west-1, us-gov-west-1 or cn-north-1
+var regionFormat = regexp.MustCompile(`^[a-z]{2}(-gov|-iso[a-z]?)?-[a-z]+-[0-9]+$`)
+
+// resolveSessionDuration returns the DurationSeconds to request, the DurationOverride of the call or else the
+// account one, awscfg.DefaultSessionDuration when neither is set, so an out of range duration is reported before
+// STS rejects it
+func resolveSessionDuration(account *awscfg.IDPAccount, opts *AWSLoginOptions) (int64, error) {
+	if opts.DurationOverride != 0 {
+		duration := int64(opts.DurationOverride / time.Second)
+		if duration < minSessionDuration || duration > maxSessionDuration {
+			return 0, errors.Errorf("Duration override of %s out of range, it must be between %s and %s.", opts.DurationOverride, minSessionDuration*time.Second, maxSessionDuration*time.Second)
+		}
+		return duration, nil
+	}
+
+	duration := int64(account.SessionDuration)
+	if duration == 0 {
+		return awscfg.DefaultSessionDuration, nil
+	}
+
+	if duration < minSessionDuration || duration > maxSessionDuration {
+		return 0, errors.Errorf("Session duration of %ds out of range, aws_session_duration must be between %d and %d seconds.", duration, minSessionDuration, maxSessionDuration)
+	}
+
+	return duration, nil
+}
+
+// resolveRegion returns the region to create the STS session in, falling back to AWS_REGION then
+// AWS_DEFAULT_REGION when it isn't set, so a typo is reported before the SDK fails to resolve an endpoint
+func resolveRegion(region string) (string, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return "", errors.New("No AWS region configured, set the account region or AWS_REGION.")
+	}
+
+	for _, partition := range endpoints.DefaultPartitions() {
+		if _, ok := partition.Regions()[region]; ok {
+			return region, nil
+		}
+	}
+
+	if !regionFormat.MatchString(region) {
+		return "", errors.Errorf("invalid region %q", region)
+	}
+
+	// well formed but newer than the SDK endpoints table
+	logger.WithField("region", region).Warn("Unknown AWS region, trying it anyway.")
+
+	return region, nil
+}
+
+// STSAPI the part of the STS client used to exchange the SAML assertion, satisfied by *sts.STS
+type STSAPI interface {
+	AssumeRoleWithSAMLWithContext(ctx aws.Context, input *awssts.AssumeRoleWithSAMLInput, opts ...request.Option) (*awssts.AssumeRoleWithSAMLOutput, error)
+}
+
+// assumeChainedRole uses the SAML derived credentials to assume opts.ChainRoleARN
+func assumeChainedRole(ctx context.Context, account *awscfg.IDPAccount, sourceCreds *awsconfig.AWSCredentials, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(sourceCreds.Region),
+		Endpoint:    aws.String(resolveSTSEndpoint(sourceCreds.Region, opts)),
+		Credentials: credentials.NewStaticCredentials(sourceCreds.AWSAccessKey, sourceCreds.AWSSecretKey, sourceCreds.AWSSessionToken),
+		HTTPClient:  opts.HTTPClient,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create session.")
+	}
+
+	svc := awssts.New(sess)
+
+	duration := account.SessionDuration
+	if opts.DurationOverride != 0 {
+		duration = int(opts.DurationOverride / time.Second)
+	}
+	if duration == 0 || duration > maxChainedSessionDuration {
+		duration = maxChainedSessionDuration
+	}
+
+	sessionName, err := roleSessionName(account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &awssts.AssumeRoleInput{
+		RoleArn:         aws.String(opts.ChainRoleARN),
+		RoleSessionName: aws.String(sessionName),
+		DurationSeconds: aws.Int64(int64(duration)),
+	}
+	if opts.ChainExternalID != "" {
+		if !validExternalID(opts.ChainExternalID) {
+			return nil, errors.Errorf("Invalid external ID for chained role %s, it must be %d to %d characters matching %s.", opts.ChainRoleARN, minExternalIDLength, maxExternalIDLength, externalIDFormat)
+		}
+		params.ExternalId = aws.String(opts.ChainExternalID)
+	}
+
+	logger.WithField("role", opts.ChainRoleARN).Info("Assuming chained role.")
+
+	var resp *awssts.AssumeRoleOutput
+	err = doWithSTSRetry(ctx, opts, func() error {
+		var err error
+		resp, err = svc.AssumeRoleWithContext(ctx, params)
+		return redact.Error(err, sourceCreds.AWSSecretKey, sourceCreds.AWSSessionToken)
+	})
+	if err != nil {
+		return nil, chainedRoleError(opts.ChainRoleARN, opts.ChainExternalID, err)
+	}
+
+	if err := checkSTSCredentials(credentialFields(resp.Credentials, resp.AssumedRoleUser)); err != nil {
+		return nil, errors.Wrapf(err, "Error assuming chained role %s.", opts.ChainRoleARN)
+	}
+
+	return stsCredentials(resp.Credentials, resp.AssumedRoleUser, sourceCreds.Region, opts), nil
+}
+
+// validExternalID whether STS accepts externalID
+func validExternalID(externalID string) bool {
+	return len(externalID) >= minExternalIDLength && len(externalID) <= maxExternalIDLength && externalIDFormat.MatchString(externalID)
+}
+
+// chainedRoleError explains a failure to assume the chained role, STS denies missing or wrong external IDs
+// with the same AccessDenied as any other trust policy mismatch
+func chainedRoleError(roleARN, externalID string, err error) error {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != "AccessDenied" {
+		return errors.Wrapf(err, "Error assuming chained role %s.", roleARN)
+	}
+
+	if externalID == "" {
+		return errors.Wrapf(err, "Access denied assuming chained role %s, if its trust policy has an sts:ExternalId condition set ChainExternalID.", roleARN)
+	}
+
+	return errors.Wrapf(err, "Access denied assuming chained role %s, check ChainExternalID matches the sts:ExternalId condition of its trust policy.", roleARN)
+}
+
+// stsCredentials the credentials of an aws-sdk-go STS response, checked by checkSTSCredentials
+func stsCredentials(creds *awssts.Credentials, user *awssts.AssumedRoleUser, region string, opts *AWSLoginOptions) *awsconfig.AWSCredentials {
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     aws.StringValue(creds.AccessKeyId),
+		AWSSecretKey:     aws.StringValue(creds.SecretAccessKey),
+		AWSSessionToken:  aws.StringValue(creds.SessionToken),
+		AWSSecurityToken: aws.StringValue(creds.SessionToken),
+		PrincipalARN:     aws.StringValue(user.Arn),
+		Expires:          expiryTime(aws.TimeValue(creds.Expiration), opts),
+		Region:           region,
+	}
+}
+
+// roleSessionName the session name of the chained or web identity role. An explicit RoleSessionName must
+// already be valid, the IdP username it defaults to is made valid.
+func roleSessionName(account *awscfg.IDPAccount, opts *AWSLoginOptions) (string, error) {
+	if opts.RoleSessionName != "" {
+		if !roleSessionNameFormat.MatchString(opts.RoleSessionName) {
+			return "", errors.Errorf("Invalid role session name %q, it must match %s.", opts.RoleSessionName, roleSessionNameFormat)
+		}
+		return opts.RoleSessionName, nil
+	}
+
+	name := roleSessionNameInvalidChars.ReplaceAllString(account.Username, "-")
+	if len(name) > maxRoleSessionNameLength {
+		name = name[:maxRoleSessionNameLength]
+	}
+	if len(name) < 2 {
+		return defaultRoleSessionName, nil
+	}
+
+	return name, nil
+}
+
+// warnIfSessionCapped explains a session lasting well short of the requested duration. STS silently caps the
+// session at the lifetime of the SAML assertion, e.g. the SessionNotOnOrAfter set by the IdP.
+func warnIfSessionCapped(roleARN string, requested int64, expires, now time.Time) {
+	if requested <= 0 {
+		return
+	}
+
+	want := time.Duration(requested) * time.Second
+	got := expires.Sub(now)
+	if got >= want-sessionCapTolerance {
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"role":      roleARN,
+		"requested": want.String(),
+		"granted":   got.Round(time.Second).String(),
+	}).Warn("AWS session is shorter than requested, STS capped it at the lifetime of the SAML assertion set by the IdP.")
+}
+
+// stsCredentialFields the parts of an STS response the credentials are built from, nil where missing
+type stsCredentialFields struct {
+	accessKeyID     *string
+	secretAccessKey *string
+	sessionToken    *string
+	expiration      *time.Time
+	assumedRoleARN  *string
+}
+
+// expiryTime the Expires of the credentials, in local time unless KeepExpiryUTC is set. The output
+// serializers write it in UTC either way.
+func expiryTime(expiration time.Time, opts *AWSLoginOptions) time.Time {
+	if opts.KeepExpiryUTC {
+		return expiration.UTC()
+	}
+
+	return expiration.Local()
+}
+
+// credentialFields the credential fields of an aws-sdk-go STS response
+func credentialFields(creds *awssts.Credentials, user *awssts.AssumedRoleUser) stsCredentialFields {
+	fields := stsCredentialFields{}
+	if creds != nil {
+		fields.accessKeyID = creds.AccessKeyId
+		fields.secretAccessKey = creds.SecretAccessKey
+		fields.sessionToken = creds.SessionToken
+		fields.expiration = creds.Expiration
+	}
+	if user != nil {
+		fields.assumedRoleARN = user.Arn
+	}
+
+	return fields
+}
+
+// checkSTSCredentials refuses an STS response missing a part of the credentials, as sent by a broken or
+// mocked endpoint, rather than building credentials that can't work
+func checkSTSCredentials(fields stsCredentialFields) error {
+	missing := []string{}
+	if fields.accessKeyID == nil {
+		missing = append(missing, "AccessKeyId")
+	}
+	if fields.secretAccessKey == nil {
+		missing = append(missing, "SecretAccessKey")
+	}
+	if fields.sessionToken == nil {
+		missing = append(missing, "SessionToken")
+	}
+	if fields.expiration == nil {
+		missing = append(missing, "Expiration")
+	}
+	if fields.assumedRoleARN == nil {
+		missing = append(missing, "AssumedRoleUser.Arn")
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("Incomplete STS response, missing %s.", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// doWithSTSRetry calls fn until it succeeds, fails with a non transient error or runs out of attempts
+func doWithSTSRetry(ctx context.Context, opts *AWSLoginOptions, fn func() error) error {
+	attempts := opts.STSAttempts
+	if attempts == 0 {
+		attempts = DefaultSTSAttempts
+	}
+
+	delay := opts.STSRetryDelay
+	if delay == 0 {
+		delay = DefaultSTSRetryDelay
+	}
+
+	return retry.Do(
+		fn,
+		retry.Context(ctx),
+		retry.Attempts(attempts),
+		retry.Delay(delay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(isRetryableSTSError),
+		retry.OnRetry(
+			func(n uint, err error) {
+				log := logger.WithField("attempt", n+1).WithError(err)
+				if requestID := awsRequestID(err); requestID != "" {
+					log = log.WithField("request_id", requestID)
+				}
+				log.Warn("STS request failed, retrying")
+			}),
+	)
+}
+
+// isRetryableSTSError only request errors, throttling and 5xx responses are worth retrying,
+// access denied or an expired assertion fail the same way every time
+func isRetryableSTSError(err error) bool {
+	var reqFailure awserr.RequestFailure
+	if errors.As(err, &reqFailure) && reqFailure.StatusCode() >= 500 {
+		return true
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, "Throttling", "ThrottlingException":
+			return true
+		}
+	}
+
+	return false
+}
+
+// signinDefaultRegions the region to default to for the sign-in endpoint of each partition
+var signinDefaultRegions = map[string]string{
+	"signin.aws.amazon.com":       "us-east-1",
+	"signin.amazonaws.com":        "us-east-1",
+	"signin.amazonaws-us-gov.com": "us-gov-west-1",
+	"signin.amazonaws.cn":         "cn-north-1",
+}
+
+// regionFromDestination infers a region from the sign-in endpoint the assertion is addressed to, the region
+// of a regional endpoint (us-east-2.signin.aws.amazon.com) or else the default region of the partition.
+// It returns an empty string for unknown endpoints.
+func regionFromDestination(destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+
+	host := u.Hostname()
+	for signinHost, region := range signinDefaultRegions {
+		if host == signinHost {
+			return region
+		}
+		if prefix := strings.TrimSuffix(host, "."+signinHost); prefix != host && regionFormat.MatchString(prefix) {
+			return prefix
+		}
+	}
+
+	return ""
+}
+
+// withRoleRegion returns a copy of the account with the region RoleRegions maps the role to, if any
+func withRoleRegion(account *awscfg.IDPAccount, role *saml2aws.AWSRole, opts *AWSLoginOptions) *awscfg.IDPAccount {
+	region, ok := opts.RoleRegions[role.RoleARN]
+	if !ok || region == "" {
+		return account
+	}
+
+	regionAccount := *account
+	regionAccount.Region = region
+	return &regionAccount
+}
+
+// withDestinationRegion returns a copy of the account defaulting its region to the one inferred from the
+// destination of the assertion, when neither the account nor the environment configure one
+func withDestinationRegion(account *awscfg.IDPAccount, samlAssertion string) *awscfg.IDPAccount {
+	if account.Region != "" || os.Getenv("AWS_REGION") != "" || os.Getenv("AWS_DEFAULT_REGION") != "" {
+		return account
+	}
+
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return account
+	}
+
+	destination, err := saml2aws.ExtractDestinationURL(data)
+	if err != nil {
+		return account
+	}
+
+	region := regionFromDestination(destination)
+	if region == "" {
+		return account
+	}
+
+	logger.WithField("region", region).Info("No AWS region configured, using the region of the SAML destination.")
+
+	regionAccount := *account
+	regionAccount.Region = region
+	return &regionAccount
+}
+
+// partitionDNSSuffixes the domain of the endpoints of each partition
+var partitionDNSSuffixes = map[string]string{
+	endpoints.AwsPartitionID:      "amazonaws.com",
+	endpoints.AwsUsGovPartitionID: "amazonaws.com",
+	endpoints.AwsCnPartitionID:    "amazonaws.com.cn",
+}
+
+// validatePartition checks that the region and the ARNs of the role belong to the partition
+func validatePartition(partition string, region string, role *saml2aws.AWSRole) error {
+	if _, ok := partitionDNSSuffixes[partition]; !ok {
+		return errors.Errorf("Unsupported AWS partition %q.", partition)
+	}
+
+	regionPartition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok || regionPartition.ID() != partition {
+		return errors.Errorf("Region %s isn't part of the AWS partition %s.", region, partition)
+	}
+
+	prefix := "arn:" + partition + ":"
+	for _, arn := range []string{role.RoleARN, role.PrincipalARN} {
+		if !strings.HasPrefix(arn, prefix) {
+			return errors.Errorf("%s isn't part of the AWS partition %s.", arn, partition)
+		}
+	}
+
+	return nil
+}
+
+// resolveSTSEndpoint the STS endpoint to use for the region, an explicit override always wins.
+// With a partition configured its regional endpoint is used, otherwise GovCloud and China regions get
+// their partition endpoint and the SDK default is used for the others (empty string).
+func resolveSTSEndpoint(region string, opts *AWSLoginOptions) string {
+	if opts.STSEndpoint != "" {
+		return opts.STSEndpoint
+	}
+
+	if suffix, ok := partitionDNSSuffixes[opts.Partition]; ok {
+		return fmt.Sprintf("sts.%s.%s", region, suffix)
+	}
+
+	switch {
+	case strings.HasPrefix(region, "us-gov-"):
+		return fmt.Sprintf("sts.%s.amazonaws.com", region)
+	case strings.HasPrefix(region, "cn-"):
+		return fmt.Sprintf("sts.%s.amazonaws.com.cn", region)
+	}
+
+	return ""
+}
+
+// warnSessionDurationClamped reports the retry of a session duration STS rejected with the lowest
+// MaxSessionDuration there is, STS doesn't tell the actual maximum of the role
+func warnSessionDurationClamped(roleARN string, requested int64) {
+	logger.WithFields(logrus.Fields{
+		"role":               roleARN,
+		"requested_duration": requested,
+		"granted_duration":   minMaxSessionDuration,
+	}).Warnf("Session duration of %ds exceeds the MaxSessionDuration of the role, retrying with %ds, the lowest MaxSessionDuration, which may be shorter than the maximum of the role.", requested, minMaxSessionDuration)
+}
+
+// isSessionDurationTooLongError STS rejects a DurationSeconds above the MaxSessionDuration of the role
+// with a ValidationError which doesn't tell the maximum
+func isSessionDurationTooLongError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "DurationSeconds exceeds")
+}
+
+// validateSessionPolicy checks the session policy options before they are sent to STS
+func validateSessionPolicy(opts *AWSLoginOptions) error {
+	if opts.SessionPolicy != "" && !json.Valid([]byte(opts.SessionPolicy)) {
+		return errors.New("Session policy isn't valid JSON.")
+	}
+
+	for _, policyARN := range opts.SessionPolicyARNs {
+		if !strings.HasPrefix(policyARN, "arn:") {
+			return errors.Errorf("Invalid session policy ARN %q.", policyARN)
+		}
+	}
+
+	return nil
+}
+
+// isAssertionExpiredError reports whether STS refused the SAML assertion because it expired
+func isAssertionExpiredError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "ExpiredTokenException") || strings.Contains(msg, "Token must be redeemed")
+}
+
+// sessionDurationTooLongError explains how to fix a session duration refused by the role
+func sessionDurationTooLongError(roleARN string, duration int64) error {
+	return errors.Errorf("Session duration of %ds exceeds the MaxSessionDuration of role %s. Lower aws_session_duration to at most the role maximum (%ds unless raised in IAM).", duration, roleARN, minMaxSessionDuration)
+}
@@ -0,0 +1,86 @@
+package samllogin
+
+import (
+	"context"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/sirupsen/logrus"
+)
+
+// packedPolicyWarnPercent the PackedPolicySize from which the session policy and tags are reported as close to
+// the limit STS rejects them beyond
+const packedPolicyWarnPercent = 90
+
+// STSResponseMetadata describes the response of the AssumeRoleWithSAML call of a login
+type STSResponseMetadata struct {
+	// RequestID the x-amzn-RequestId of the response, which AWS support asks for
+	RequestID string
+	// HTTPStatusCode the HTTP status of the response
+	HTTPStatusCode int
+	// PackedPolicySize how close the session policy and session tags are to the size limit, in percent. 0 when
+	// STS didn't return it, which it only does when there is a session policy or there are tags.
+	PackedPolicySize int64
+}
+
+type stsMetadataKey struct{}
+
+// withSTSMetadata returns a context the STS calls record the metadata of their response into, see
+// recordSTSResponse
+func withSTSMetadata(ctx context.Context) (context.Context, *STSResponseMetadata) {
+	metadata := &STSResponseMetadata{}
+	return context.WithValue(ctx, stsMetadataKey{}, metadata), metadata
+}
+
+// stsMetadata the metadata recorded for ctx, nil when nothing is recording
+func stsMetadata(ctx context.Context) *STSResponseMetadata {
+	metadata, _ := ctx.Value(stsMetadataKey{}).(*STSResponseMetadata)
+	return metadata
+}
+
+// recordSTSResponse an aws-sdk-go request option recording the request ID and HTTP status of the response
+func recordSTSResponse(ctx context.Context) request.Option {
+	return func(r *request.Request) {
+		metadata := stsMetadata(ctx)
+		if metadata == nil {
+			return
+		}
+
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			metadata.RequestID = r.RequestID
+			if r.HTTPResponse != nil {
+				metadata.HTTPStatusCode = r.HTTPResponse.StatusCode
+			}
+		})
+	}
+}
+
+// recordSTSResultMetadataV2 records the request ID and HTTP status of an aws-sdk-go-v2 response
+func recordSTSResultMetadataV2(ctx context.Context, resultMetadata middleware.Metadata) {
+	metadata := stsMetadata(ctx)
+	if metadata == nil {
+		return
+	}
+
+	metadata.RequestID, _ = awsmiddleware.GetRequestIDMetadata(resultMetadata)
+	if resp, ok := awsmiddleware.GetRawResponse(resultMetadata).(*smithyhttp.Response); ok && resp.Response != nil {
+		metadata.HTTPStatusCode = resp.StatusCode
+	}
+}
+
+// observePackedPolicySize records the PackedPolicySize STS returned for the role and warns when it is close
+// to the limit, growing the session policy or the tags any further would fail the login
+func observePackedPolicySize(ctx context.Context, roleARN string, packedPolicySize int64) {
+	if metadata := stsMetadata(ctx); metadata != nil {
+		metadata.PackedPolicySize = packedPolicySize
+	}
+
+	if packedPolicySize >= packedPolicyWarnPercent {
+		logger.WithFields(logrus.Fields{
+			"role":               roleARN,
+			"packed_policy_size": packedPolicySize,
+		}).Warnf("Session policy and tags are at %d%% of the size STS accepts, they are about to be rejected.", packedPolicySize)
+	}
+}
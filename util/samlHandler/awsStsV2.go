@@ -0,0 +1,126 @@
+package samllogin
+
+import (
+	"context"
+	"strings"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	"gocloak/util/samlHandler/redact"
+
+	//aws-sdk-v2
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	awsv2config "github.com/aws/aws-sdk-go-v2/config"
+	awsv2sts "github.com/aws/aws-sdk-go-v2/service/sts"
+	awsv2ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+
+	"github.com/pkg/errors"
+)
+
+// loginToStsUsingRoleV2 is the aws-sdk-go-v2 counterpart of loginToStsUsingRoleALIAWS
+func loginToStsUsingRoleV2(ctx context.Context, account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+
+	region, err := resolveRegion(account.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := resolveSessionDuration(account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	loadOpts := []func(*awsv2config.LoadOptions) error{awsv2config.WithRegion(region)}
+	if opts.HTTPClient != nil {
+		loadOpts = append(loadOpts, awsv2config.WithHTTPClient(opts.HTTPClient))
+	}
+
+	cfg, err := awsv2config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load AWS config.")
+	}
+
+	svc := awsv2sts.NewFromConfig(cfg, func(o *awsv2sts.Options) {
+		if endpoint := resolveSTSEndpoint(region, opts); endpoint != "" {
+			if !strings.Contains(endpoint, "://") {
+				endpoint = "https://" + endpoint
+			}
+			o.BaseEndpoint = awsv2.String(endpoint)
+		}
+	})
+
+	params := &awsv2sts.AssumeRoleWithSAMLInput{
+		PrincipalArn:    awsv2.String(role.PrincipalARN), // Required
+		RoleArn:         awsv2.String(role.RoleARN),      // Required
+		SAMLAssertion:   awsv2.String(samlAssertion),     // Required
+		DurationSeconds: awsv2.Int32(int32(duration)),
+	}
+	if opts.SessionPolicy != "" {
+		params.Policy = awsv2.String(opts.SessionPolicy)
+	}
+	for _, policyARN := range opts.SessionPolicyARNs {
+		params.PolicyArns = append(params.PolicyArns, awsv2ststypes.PolicyDescriptorType{Arn: awsv2.String(policyARN)})
+	}
+
+	logger.Info("Requesting AWS credentials using SAML assertion.")
+
+	// the SDK may echo the request, assertion included, in its error
+	resp, err := svc.AssumeRoleWithSAML(ctx, params)
+	err = redact.Error(err, samlAssertion)
+	if isSessionDurationTooLongError(err) {
+		requested := int64(awsv2.ToInt32(params.DurationSeconds))
+		if requested <= minMaxSessionDuration {
+			return nil, sessionDurationTooLongError(role.RoleARN, requested)
+		}
+
+		warnSessionDurationClamped(role.RoleARN, requested)
+		params.DurationSeconds = awsv2.Int32(minMaxSessionDuration)
+
+		resp, err = svc.AssumeRoleWithSAML(ctx, params)
+		err = redact.Error(err, samlAssertion)
+		if isSessionDurationTooLongError(err) {
+			return nil, sessionDurationTooLongError(role.RoleARN, requested)
+		}
+	}
+	if isAssertionExpiredError(err) {
+		return nil, errors.Wrap(ErrAssertionExpired, err.Error())
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error retrieving STS credentials using SAML.")
+	}
+
+	if err := checkSTSCredentials(credentialFieldsV2(resp.Credentials, resp.AssumedRoleUser)); err != nil {
+		return nil, err
+	}
+
+	warnIfSessionCapped(role.RoleARN, int64(awsv2.ToInt32(params.DurationSeconds)), awsv2.ToTime(resp.Credentials.Expiration), opts.now())
+	recordSTSResultMetadataV2(ctx, resp.ResultMetadata)
+	observePackedPolicySize(ctx, role.RoleARN, int64(awsv2.ToInt32(resp.PackedPolicySize)))
+
+	return &awsconfig.AWSCredentials{
+		AWSAccessKey:     awsv2.ToString(resp.Credentials.AccessKeyId),
+		AWSSecretKey:     awsv2.ToString(resp.Credentials.SecretAccessKey),
+		AWSSessionToken:  awsv2.ToString(resp.Credentials.SessionToken),
+		AWSSecurityToken: awsv2.ToString(resp.Credentials.SessionToken),
+		PrincipalARN:     awsv2.ToString(resp.AssumedRoleUser.Arn),
+		Expires:          expiryTime(awsv2.ToTime(resp.Credentials.Expiration), opts),
+		Region:           region,
+	}, nil
+}
+
+// credentialFieldsV2 the credential fields of an aws-sdk-go-v2 STS response
+func credentialFieldsV2(creds *awsv2ststypes.Credentials, user *awsv2ststypes.AssumedRoleUser) stsCredentialFields {
+	fields := stsCredentialFields{}
+	if creds != nil {
+		fields.accessKeyID = creds.AccessKeyId
+		fields.secretAccessKey = creds.SecretAccessKey
+		fields.sessionToken = creds.SessionToken
+		fields.expiration = creds.Expiration
+	}
+	if user != nil {
+		fields.assumedRoleARN = user.Arn
+	}
+
+	return fields
+}
@@ -0,0 +1,419 @@
+package samllogin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSTS answers AssumeRoleWithSAML with the queued errors, then with credentials expiring at expiration,
+// in 2024 when unset, and packedPolicySize when set
+type fakeSTS struct {
+	errs             []error
+	calls            int
+	inputs           []*awssts.AssumeRoleWithSAMLInput
+	expiration       time.Time
+	packedPolicySize int64
+}
+
+func (f *fakeSTS) AssumeRoleWithSAMLWithContext(ctx aws.Context, input *awssts.AssumeRoleWithSAMLInput, opts ...request.Option) (*awssts.AssumeRoleWithSAMLOutput, error) {
+	f.calls++
+	f.inputs = append(f.inputs, input)
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+
+	expiration := f.expiration
+	if expiration.IsZero() {
+		expiration = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	output := &awssts.AssumeRoleWithSAMLOutput{
+		AssumedRoleUser: &awssts.AssumedRoleUser{
+			Arn: aws.String("arn:aws:sts::123456789012:assumed-role/Admin/user@example.com"),
+		},
+		Credentials: &awssts.Credentials{
+			AccessKeyId:     aws.String("ASIAEXAMPLE"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(expiration),
+		},
+	}
+	if f.packedPolicySize != 0 {
+		output.PackedPolicySize = aws.Int64(f.packedPolicySize)
+	}
+
+	return output, nil
+}
+
+var (
+	testAccount = &awscfg.IDPAccount{Region: "us-east-1", SessionDuration: 3600}
+	testRole    = &saml2aws.AWSRole{
+		RoleARN:      "arn:aws:iam::123456789012:role/Admin",
+		PrincipalARN: "arn:aws:iam::123456789012:saml-provider/keycloak",
+	}
+)
+
+func testSTSOptions(fake *fakeSTS) *AWSLoginOptions {
+	return &AWSLoginOptions{STSClient: fake, STSRetryDelay: time.Millisecond}
+}
+
+func TestLoginToStsUsingRoleSuccess(t *testing.T) {
+	fake := &fakeSTS{}
+
+	awsCreds, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, testRole.RoleARN, aws.StringValue(fake.inputs[0].RoleArn))
+	assert.Equal(t, testRole.PrincipalARN, aws.StringValue(fake.inputs[0].PrincipalArn))
+	assert.Equal(t, "assertion", aws.StringValue(fake.inputs[0].SAMLAssertion))
+	assert.Equal(t, int64(3600), aws.Int64Value(fake.inputs[0].DurationSeconds))
+
+	assert.Equal(t, "ASIAEXAMPLE", awsCreds.AWSAccessKey)
+	assert.Equal(t, "secret", awsCreds.AWSSecretKey)
+	assert.Equal(t, "token", awsCreds.AWSSessionToken)
+	assert.Equal(t, "arn:aws:sts::123456789012:assumed-role/Admin/user@example.com", awsCreds.PrincipalARN)
+	assert.Equal(t, "us-east-1", awsCreds.Region)
+}
+
+func TestLoginToStsUsingRoleRetriesThrottling(t *testing.T) {
+	fake := &fakeSTS{errs: []error{awserr.New("Throttling", "Rate exceeded", nil)}}
+
+	awsCreds, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.Nil(t, err)
+
+	assert.Equal(t, 2, fake.calls)
+	assert.Equal(t, "ASIAEXAMPLE", awsCreds.AWSAccessKey)
+}
+
+func TestLoginToStsUsingRoleGivesUpOnPersistentThrottling(t *testing.T) {
+	throttled := awserr.New("Throttling", "Rate exceeded", nil)
+	fake := &fakeSTS{errs: []error{throttled, throttled, throttled}}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.NotNil(t, err)
+
+	assert.Equal(t, DefaultSTSAttempts, fake.calls)
+	assert.Contains(t, err.Error(), "Rate exceeded")
+}
+
+func TestLoginToStsUsingRoleDoesNotRetryAccessDenied(t *testing.T) {
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRoleWithSAML", nil), 403, "request-id")
+	fake := &fakeSTS{errs: []error{denied}}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.NotNil(t, err)
+
+	assert.Equal(t, 1, fake.calls)
+	assert.Contains(t, err.Error(), "AccessDenied")
+}
+
+// v2ResponseError stands in for the aws-sdk-go-v2 *http.ResponseError, which can't be built without a response
+type v2ResponseError string
+
+func (e v2ResponseError) Error() string            { return "https response error StatusCode: 403" }
+func (e v2ResponseError) ServiceRequestID() string { return string(e) }
+
+func TestLoginErrorCarriesRequestID(t *testing.T) {
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRoleWithSAML", nil), 403, "4a9e1c2f-request-id")
+	fake := &fakeSTS{errs: []error{denied}}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.NotNil(t, err)
+
+	err = newLoginError(ErrSTS, err, "Error logging into AWS role using SAML assertion.")
+
+	var loginErr *LoginError
+	require.True(t, errors.As(err, &loginErr))
+	assert.Equal(t, "4a9e1c2f-request-id", loginErr.RequestID)
+	assert.Contains(t, err.Error(), "(x-amzn-RequestId: 4a9e1c2f-request-id)")
+
+	out, err := json.Marshal(err)
+	require.Nil(t, err)
+	var doc map[string]string
+	require.Nil(t, json.Unmarshal(out, &doc))
+	assert.Equal(t, ErrSTS.Error(), doc["kind"])
+	assert.Equal(t, "4a9e1c2f-request-id", doc["requestId"])
+	assert.Contains(t, doc["error"], "AccessDenied")
+
+	v2Err := errors.Wrap(v2ResponseError("v2-request-id"), "Error retrieving STS credentials using SAML.")
+	assert.Equal(t, "v2-request-id", awsRequestID(v2Err))
+
+	out, err = json.Marshal(newLoginError(ErrSTS, errors.New("no AWS request"), ""))
+	require.Nil(t, err)
+	assert.NotContains(t, string(out), "requestId")
+}
+
+func TestChainedRoleError(t *testing.T) {
+	chainRoleARN := "arn:aws:iam::210987654321:role/Vendor"
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "User is not authorized to perform: sts:AssumeRole", nil), 403, "request-id")
+
+	err := chainedRoleError(chainRoleARN, "", denied)
+	assert.Contains(t, err.Error(), "if its trust policy has an sts:ExternalId condition set ChainExternalID")
+	assert.Contains(t, err.Error(), chainRoleARN)
+
+	err = chainedRoleError(chainRoleARN, "vendor-id", denied)
+	assert.Contains(t, err.Error(), "check ChainExternalID matches")
+
+	var reqFailure awserr.RequestFailure
+	assert.True(t, errors.As(err, &reqFailure), "the SDK error stays reachable")
+
+	throttled := awserr.New("Throttling", "Rate exceeded", nil)
+	err = chainedRoleError(chainRoleARN, "", throttled)
+	assert.Equal(t, "Error assuming chained role "+chainRoleARN+".: Throttling: Rate exceeded", err.Error())
+}
+
+func TestAssumeChainedRoleRejectsInvalidExternalID(t *testing.T) {
+	opts := &AWSLoginOptions{ChainRoleARN: "arn:aws:iam::210987654321:role/Vendor", ChainExternalID: "has spaces"}
+
+	_, err := assumeChainedRole(context.Background(), testAccount, testCreds, opts)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Invalid external ID for chained role")
+	assert.NotContains(t, err.Error(), "has spaces")
+
+	assert.True(t, validExternalID("urn:vendor/tenant-42@example.com"))
+	assert.False(t, validExternalID("x"))
+	assert.False(t, validExternalID(strings.Repeat("x", maxExternalIDLength+1)))
+}
+
+func TestLoginToStsUsingRoleWarnsOnPackedPolicySize(t *testing.T) {
+	hook := captureLogs(t)
+
+	ctx, metadata := withSTSMetadata(context.Background())
+	fake := &fakeSTS{packedPolicySize: 93, expiration: time.Now().Add(time.Hour)}
+
+	_, err := loginToStsUsingRoleALIAWS(ctx, testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.Nil(t, err)
+
+	assert.Equal(t, int64(93), metadata.PackedPolicySize)
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "93%")
+	assert.Equal(t, testRole.RoleARN, hook.LastEntry().Data["role"])
+
+	hook.Reset()
+	fake.packedPolicySize = 40
+	_, err = loginToStsUsingRoleALIAWS(ctx, testAccount, testRole, "assertion", testSTSOptions(fake))
+	require.Nil(t, err)
+
+	assert.Equal(t, int64(40), metadata.PackedPolicySize)
+	for _, entry := range hook.AllEntries() {
+		assert.NotEqual(t, logrus.WarnLevel, entry.Level, entry.Message)
+	}
+}
+
+func TestRecordSTSResponse(t *testing.T) {
+	ctx, metadata := withSTSMetadata(context.Background())
+
+	r := &request.Request{RequestID: "4a9e1c2f-request-id", HTTPResponse: &http.Response{StatusCode: http.StatusOK}}
+	recordSTSResponse(ctx)(r)
+	r.Handlers.Complete.Run(r)
+
+	assert.Equal(t, &STSResponseMetadata{RequestID: "4a9e1c2f-request-id", HTTPStatusCode: http.StatusOK}, metadata)
+
+	// nothing recording
+	r = &request.Request{RequestID: "other"}
+	recordSTSResponse(context.Background())(r)
+	r.Handlers.Complete.Run(r)
+	assert.Equal(t, "4a9e1c2f-request-id", metadata.RequestID)
+}
+
+func TestRoleSessionName(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		override string
+		want     string
+		wantErr  bool
+	}{
+		{name: "defaults to the username", username: "alice@example.com", want: "alice@example.com"},
+		{name: "invalid characters replaced", username: "DOMAIN\\alice smith", want: "DOMAIN-alice-smith"},
+		{name: "truncated to 64 characters", username: strings.Repeat("a", 70), want: strings.Repeat("a", 64)},
+		{name: "no username", want: defaultRoleSessionName},
+		{name: "explicit override", username: "alice", override: "audit.alice", want: "audit.alice"},
+		{name: "invalid override", username: "alice", override: "alice smith", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account := &awscfg.IDPAccount{Username: tt.username}
+
+			got, err := roleSessionName(account, &AWSLoginOptions{RoleSessionName: tt.override})
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWarnIfSessionCapped(t *testing.T) {
+	hook := captureLogs(t)
+	now := time.Now()
+
+	warnIfSessionCapped(testRole.RoleARN, 43200, now.Add(time.Hour), now)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Equal(t, "12h0m0s", hook.LastEntry().Data["requested"])
+	assert.Equal(t, "1h0m0s", hook.LastEntry().Data["granted"])
+
+	hook.Reset()
+	warnIfSessionCapped(testRole.RoleARN, 3600, now.Add(time.Hour-time.Minute), now)
+	assert.Empty(t, hook.AllEntries())
+}
+
+// partialSTS answers AssumeRoleWithSAML without the credentials, like a broken or mocked endpoint
+type partialSTS struct{}
+
+func (p *partialSTS) AssumeRoleWithSAMLWithContext(ctx aws.Context, input *awssts.AssumeRoleWithSAMLInput, opts ...request.Option) (*awssts.AssumeRoleWithSAMLOutput, error) {
+	return &awssts.AssumeRoleWithSAMLOutput{
+		AssumedRoleUser: &awssts.AssumedRoleUser{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/Admin/user")},
+	}, nil
+}
+
+func TestLoginToStsUsingRolePartialResponse(t *testing.T) {
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", &AWSLoginOptions{STSClient: &partialSTS{}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "missing AccessKeyId, SecretAccessKey, SessionToken, Expiration")
+}
+
+func TestLoginToStsUsingRoleKeepExpiryUTC(t *testing.T) {
+	opts := testSTSOptions(&fakeSTS{})
+	opts.KeepExpiryUTC = true
+
+	awsCreds, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, "assertion", opts)
+	require.Nil(t, err)
+	assert.Equal(t, time.UTC, awsCreds.Expires.Location())
+	assert.True(t, awsCreds.Expires.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+}
+
+func TestLoginToStsUsingRoleRedactsAssertionFromErrors(t *testing.T) {
+	assertion := "PHNhbWxwOlJlc3BvbnNlIHhtbG5zOnNhbWxwPSJ1cm46b2FzaXM6bmFtZXM6dGM6U0FNTDoyLjA6cHJvdG9jb2wiLz4="
+	echoed := awserr.NewRequestFailure(
+		awserr.New("InvalidIdentityToken", "failed to validate Action=AssumeRoleWithSAML&SAMLAssertion="+url.QueryEscape(assertion)+"&Version=2011-06-15", nil),
+		400, "req-1")
+	fake := &fakeSTS{errs: []error{echoed}}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), testAccount, testRole, assertion, testSTSOptions(fake))
+	require.NotNil(t, err)
+
+	assert.NotContains(t, err.Error(), assertion)
+	assert.NotContains(t, err.Error(), url.QueryEscape(assertion))
+	assert.Contains(t, err.Error(), "SAMLAssertion=[REDACTED]")
+	assert.Contains(t, err.Error(), "InvalidIdentityToken")
+
+	var reqFailure awserr.RequestFailure
+	assert.True(t, errors.As(err, &reqFailure), "the SDK error stays reachable")
+}
+
+func TestWithRoleRegion(t *testing.T) {
+	opts := &AWSLoginOptions{RoleRegions: map[string]string{testRole.RoleARN: "eu-west-1"}}
+
+	account := withRoleRegion(testAccount, testRole, opts)
+	assert.Equal(t, "eu-west-1", account.Region)
+	assert.Equal(t, "us-east-1", testAccount.Region)
+
+	other := &saml2aws.AWSRole{RoleARN: "arn:aws:iam::123456789012:role/ReadOnly"}
+	assert.Equal(t, "us-east-1", withRoleRegion(testAccount, other, opts).Region)
+	assert.Equal(t, "us-east-1", withRoleRegion(testAccount, testRole, &AWSLoginOptions{}).Region)
+}
+
+func TestResolveSessionDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration int
+		want     int64
+		wantErr  bool
+	}{
+		{name: "unset", duration: 0, want: 3600},
+		{name: "minimum", duration: 900, want: 900},
+		{name: "maximum", duration: 43200, want: 43200},
+		{name: "too short", duration: 60, wantErr: true},
+		{name: "too long", duration: 86400, wantErr: true},
+		{name: "negative", duration: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSessionDuration(&awscfg.IDPAccount{SessionDuration: tt.duration}, &AWSLoginOptions{})
+			if tt.wantErr {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestResolveSessionDurationOverride(t *testing.T) {
+	account := &awscfg.IDPAccount{SessionDuration: 43200}
+
+	got, err := resolveSessionDuration(account, &AWSLoginOptions{DurationOverride: 15 * time.Minute})
+	require.Nil(t, err)
+	assert.Equal(t, int64(900), got)
+	assert.Equal(t, 43200, account.SessionDuration)
+
+	_, err = resolveSessionDuration(account, &AWSLoginOptions{DurationOverride: time.Minute})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "between 15m0s and 12h0m0s")
+
+	_, err = resolveSessionDuration(account, &AWSLoginOptions{DurationOverride: 24 * time.Hour})
+	assert.NotNil(t, err)
+}
+
+func TestLoginToStsUsingRoleRejectsSessionDurationOutOfRange(t *testing.T) {
+	fake := &fakeSTS{}
+	account := &awscfg.IDPAccount{Region: "us-east-1", SessionDuration: 60}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), account, testRole, "assertion", testSTSOptions(fake))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "aws_session_duration")
+	assert.Equal(t, 0, fake.calls)
+}
+
+func TestLoginToStsUsingRoleClampsSessionDuration(t *testing.T) {
+	hook := captureLogs(t)
+
+	tooLong := awserr.NewRequestFailure(awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil), 400, "request-id")
+	fake := &fakeSTS{errs: []error{tooLong}, expiration: time.Now().Add(time.Hour)}
+	account := &awscfg.IDPAccount{Region: "us-east-1", SessionDuration: 43200}
+
+	_, err := loginToStsUsingRoleALIAWS(context.Background(), account, testRole, "assertion", testSTSOptions(fake))
+	require.Nil(t, err)
+
+	require.Equal(t, 2, fake.calls)
+	assert.Equal(t, int64(3600), aws.Int64Value(fake.inputs[1].DurationSeconds))
+
+	var clamped *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "retrying with 3600s") {
+			clamped = entry
+		}
+	}
+	require.NotNil(t, clamped, "the clamp is logged at warn level")
+	assert.Equal(t, int64(43200), clamped.Data["requested_duration"])
+	assert.Equal(t, minMaxSessionDuration, clamped.Data["granted_duration"])
+}
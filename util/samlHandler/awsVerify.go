@@ -0,0 +1,71 @@
+package samllogin
+
+import (
+	"context"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CallerIdentityAPI the part of the STS client used to verify credentials, satisfied by *sts.STS
+type CallerIdentityAPI interface {
+	GetCallerIdentityWithContext(ctx aws.Context, input *awssts.GetCallerIdentityInput, opts ...request.Option) (*awssts.GetCallerIdentityOutput, error)
+}
+
+// VerifyCredentials checks the credentials actually work by asking STS who they belong to,
+// returning the account, ARN and user ID.
+func VerifyCredentials(awsCreds *awsconfig.AWSCredentials) (*awssts.GetCallerIdentityOutput, error) {
+	return VerifyCredentialsWithOptions(context.Background(), awsCreds, nil)
+}
+
+// VerifyCredentialsWithOptions runs VerifyCredentials with the STS endpoint, HTTP client and
+// CallerIdentityClient of opts, a nil opts behaves like VerifyCredentials.
+func VerifyCredentialsWithOptions(ctx context.Context, awsCreds *awsconfig.AWSCredentials, opts *AWSLoginOptions) (*awssts.GetCallerIdentityOutput, error) {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	if awsCreds == nil {
+		return nil, errors.New("No credentials to verify.")
+	}
+
+	svc := opts.CallerIdentityClient
+	if svc == nil {
+		region, err := resolveRegion(awsCreds.Region)
+		if err != nil {
+			return nil, err
+		}
+
+		sess, err := session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Endpoint:    aws.String(resolveSTSEndpoint(region, opts)),
+			Credentials: credentials.NewStaticCredentials(awsCreds.AWSAccessKey, awsCreds.AWSSecretKey, awsCreds.AWSSessionToken),
+			HTTPClient:  opts.HTTPClient,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create session.")
+		}
+
+		svc = awssts.New(sess)
+	}
+
+	identity, err := svc.GetCallerIdentityWithContext(ctx, &awssts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error verifying AWS credentials.")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"account": aws.StringValue(identity.Account),
+		"arn":     aws.StringValue(identity.Arn),
+	}).Debug("Verified AWS credentials.")
+
+	return identity, nil
+}
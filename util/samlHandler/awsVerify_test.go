@@ -0,0 +1,46 @@
+package samllogin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCallerIdentity answers GetCallerIdentity with err, or else with the identity of testCreds
+type fakeCallerIdentity struct {
+	err error
+}
+
+func (f *fakeCallerIdentity) GetCallerIdentityWithContext(ctx aws.Context, input *awssts.GetCallerIdentityInput, opts ...request.Option) (*awssts.GetCallerIdentityOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &awssts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String(testCreds.PrincipalARN),
+		UserId:  aws.String("AROAEXAMPLE:user"),
+	}, nil
+}
+
+func TestVerifyCredentials(t *testing.T) {
+	identity, err := VerifyCredentialsWithOptions(context.Background(), testCreds, &AWSLoginOptions{CallerIdentityClient: &fakeCallerIdentity{}})
+	require.Nil(t, err)
+
+	assert.Equal(t, "123456789012", aws.StringValue(identity.Account))
+	assert.Equal(t, testCreds.PrincipalARN, aws.StringValue(identity.Arn))
+}
+
+func TestVerifyCredentialsRejected(t *testing.T) {
+	fake := &fakeCallerIdentity{err: awserr.New("ExpiredToken", "The security token included in the request is expired", nil)}
+
+	_, err := VerifyCredentialsWithOptions(context.Background(), testCreds, &AWSLoginOptions{CallerIdentityClient: fake})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "ExpiredToken")
+}
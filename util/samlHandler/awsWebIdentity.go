@@ -0,0 +1,110 @@
+package samllogin
+
+import (
+	"context"
+
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	"gocloak/util/samlHandler/redact"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/pkg/errors"
+)
+
+// WebIdentityAPI the part of the STS client used to exchange an OIDC token, satisfied by *sts.STS
+type WebIdentityAPI interface {
+	AssumeRoleWithWebIdentityWithContext(ctx aws.Context, input *awssts.AssumeRoleWithWebIdentityInput, opts ...request.Option) (*awssts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// LoginAWSWithWebIdentity exchanges an OIDC token issued by the IdP, e.g. a Keycloak access token, for the
+// credentials of the configured role_arn. This is the OIDC federation counterpart of the SAML login, the
+// role must trust the IdP as an OIDC provider.
+func LoginAWSWithWebIdentity(ctx context.Context, account *awscfg.IDPAccount, token string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	ctx, cancel := withPhaseTimeout(ctx, opts.STSTimeout, DefaultSTSTimeout)
+	defer cancel()
+
+	awsCreds, err := loginToStsUsingWebIdentity(ctx, account, token, opts)
+	if err != nil {
+		return nil, newLoginError(ErrSTS, err, "Error logging into AWS role using web identity token.")
+	}
+
+	return awsCreds, nil
+}
+
+func loginToStsUsingWebIdentity(ctx context.Context, account *awscfg.IDPAccount, token string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if account.RoleARN == "" {
+		return nil, errors.New("No role_arn configured, it is required to assume a role with a web identity token.")
+	}
+	if token == "" {
+		return nil, errors.New("No web identity token.")
+	}
+
+	region, err := resolveRegion(account.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := resolveSessionDuration(account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionName, err := roleSessionName(account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := opts.WebIdentityClient
+	if svc == nil {
+		// AssumeRoleWithWebIdentity is unsigned, the token is the credential
+		sess, err := session.NewSession(&aws.Config{
+			Region:     aws.String(region),
+			Endpoint:   aws.String(resolveSTSEndpoint(region, opts)),
+			HTTPClient: opts.HTTPClient,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create session.")
+		}
+
+		svc = awssts.New(sess)
+	}
+
+	params := &awssts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(account.RoleARN),
+		RoleSessionName:  aws.String(sessionName),
+		WebIdentityToken: aws.String(token),
+		DurationSeconds:  aws.Int64(duration),
+	}
+	if opts.SessionPolicy != "" {
+		params.Policy = aws.String(opts.SessionPolicy)
+	}
+	for _, policyARN := range opts.SessionPolicyARNs {
+		params.PolicyArns = append(params.PolicyArns, &awssts.PolicyDescriptorType{Arn: aws.String(policyARN)})
+	}
+
+	logger.WithField("role", account.RoleARN).Info("Requesting AWS credentials using web identity token.")
+
+	var resp *awssts.AssumeRoleWithWebIdentityOutput
+	err = doWithSTSRetry(ctx, opts, func() error {
+		var err error
+		resp, err = svc.AssumeRoleWithWebIdentityWithContext(ctx, params)
+		return redact.Error(err, token)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error retrieving STS credentials using web identity token.")
+	}
+
+	if err := checkSTSCredentials(credentialFields(resp.Credentials, resp.AssumedRoleUser)); err != nil {
+		return nil, err
+	}
+
+	return stsCredentials(resp.Credentials, resp.AssumedRoleUser, region, opts), nil
+}
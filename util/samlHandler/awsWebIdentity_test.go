@@ -0,0 +1,55 @@
+package samllogin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awssts "github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWebIdentity records the AssumeRoleWithWebIdentity request and answers with credentials
+type fakeWebIdentity struct {
+	input *awssts.AssumeRoleWithWebIdentityInput
+}
+
+func (f *fakeWebIdentity) AssumeRoleWithWebIdentityWithContext(ctx aws.Context, input *awssts.AssumeRoleWithWebIdentityInput, opts ...request.Option) (*awssts.AssumeRoleWithWebIdentityOutput, error) {
+	f.input = input
+
+	return &awssts.AssumeRoleWithWebIdentityOutput{
+		AssumedRoleUser: &awssts.AssumedRoleUser{
+			Arn: aws.String("arn:aws:sts::123456789012:assumed-role/Admin/alice"),
+		},
+		Credentials: &awssts.Credentials{
+			AccessKeyId:     aws.String("ASIAOIDC"),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestLoginAWSWithWebIdentity(t *testing.T) {
+	fake := &fakeWebIdentity{}
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+
+	awsCreds, err := LoginAWSWithWebIdentity(context.Background(), account, "oidc-token", &AWSLoginOptions{WebIdentityClient: fake})
+	require.Nil(t, err)
+
+	assert.Equal(t, "ASIAOIDC", awsCreds.AWSAccessKey)
+	assert.Equal(t, "us-east-1", awsCreds.Region)
+	assert.Equal(t, testAdminRoleARN, aws.StringValue(fake.input.RoleArn))
+	assert.Equal(t, "alice", aws.StringValue(fake.input.RoleSessionName))
+	assert.Equal(t, "oidc-token", aws.StringValue(fake.input.WebIdentityToken))
+}
+
+func TestLoginAWSWithWebIdentityRequiresRoleARN(t *testing.T) {
+	_, err := LoginAWSWithWebIdentity(context.Background(), newTestIDPAccount(), "oidc-token", &AWSLoginOptions{WebIdentityClient: &fakeWebIdentity{}})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "role_arn")
+}
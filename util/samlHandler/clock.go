@@ -0,0 +1,29 @@
+package samllogin
+
+import "time"
+
+// Clock tells the time the credentials expiry, the cache freshness and the assertion validity are judged
+// against, so tests can pin it down
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock the Clock of the system time, used when AWSLoginOptions.Clock is unset
+var SystemClock Clock = systemClock{}
+
+// clock the configured Clock, or SystemClock
+func (opts *AWSLoginOptions) clock() Clock {
+	if opts.Clock == nil {
+		return SystemClock
+	}
+	return opts.Clock
+}
+
+// now the current time of the configured Clock
+func (opts *AWSLoginOptions) now() time.Time {
+	return opts.clock().Now()
+}
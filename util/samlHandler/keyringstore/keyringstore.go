@@ -0,0 +1,62 @@
+// Package keyringstore keeps the IdP passwords in the OS keyring (macOS Keychain, Windows Credential Manager,
+// Secret Service, KWallet, ...), a samllogin.CredentialStore so the password isn't typed at every login
+package keyringstore
+
+import (
+	"github.com/99designs/keyring"
+	"github.com/pkg/errors"
+)
+
+// DefaultServiceName the keyring service the passwords are stored under
+const DefaultServiceName = "mcloak"
+
+// Store reads and writes the passwords of the accounts in a keyring
+type Store struct {
+	ring keyring.Keyring
+}
+
+// New opens the keyring of the service, DefaultServiceName when empty
+func New(serviceName string) (*Store, error) {
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	ring, err := keyring.Open(keyring.Config{ServiceName: serviceName})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open the keyring")
+	}
+
+	return &Store{ring: ring}, nil
+}
+
+// NewWithKeyring wraps an already opened keyring
+func NewWithKeyring(ring keyring.Keyring) *Store {
+	return &Store{ring: ring}
+}
+
+// GetPassword returns the password stored for the account
+func (s *Store) GetPassword(account string) (string, error) {
+	item, err := s.ring.Get(account)
+	if err == keyring.ErrKeyNotFound {
+		return "", errors.Errorf("no password stored in the keyring for account %s", account)
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read the password of account %s from the keyring", account)
+	}
+
+	return string(item.Data), nil
+}
+
+// SetPassword stores the password of the account, replacing the previous one
+func (s *Store) SetPassword(account, password string) error {
+	err := s.ring.Set(keyring.Item{
+		Key:   account,
+		Data:  []byte(password),
+		Label: "mcloak password of " + account,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to store the password of account %s in the keyring", account)
+	}
+
+	return nil
+}
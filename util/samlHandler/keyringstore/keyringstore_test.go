@@ -0,0 +1,22 @@
+package keyringstore
+
+import (
+	"testing"
+
+	"github.com/99designs/keyring"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	store := NewWithKeyring(keyring.NewArrayKeyring(nil))
+
+	_, err := store.GetPassword("prod")
+	assert.NotNil(t, err)
+
+	require.Nil(t, store.SetPassword("prod", "s3cret"))
+
+	password, err := store.GetPassword("prod")
+	require.Nil(t, err)
+	assert.Equal(t, "s3cret", password)
+}
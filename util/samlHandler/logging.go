@@ -0,0 +1,41 @@
+package samllogin
+
+import (
+	"gocloak/util/samlHandler/redact"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// baseLogger the package logs to its own logger, its secrets are redacted without touching the standard logger
+// of the host application
+var baseLogger = newBaseLogger()
+
+var logger = baseLogger.WithField("pkg", "samllogin")
+
+func newBaseLogger() *logrus.Logger {
+	l := logrus.New()
+	l.AddHook(redact.Hook{})
+	return l
+}
+
+// Logger returns the logger the package logs to, to set its level or output. Its fields are redacted, hosts
+// wanting the same on their own logger add a redact.Hook to it.
+func Logger() *logrus.Logger {
+	return baseLogger
+}
+
+// SetLogFormat switches the log output between "text" (the default) and "json",
+// assertions and secrets are never part of the logged fields in either format
+func SetLogFormat(format string) error {
+	switch format {
+	case "", "text":
+		baseLogger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		baseLogger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unsupported log format %q", format)
+	}
+
+	return nil
+}
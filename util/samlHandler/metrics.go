@@ -0,0 +1,37 @@
+package samllogin
+
+import "time"
+
+// Phases of the login reported to Metrics.ObserveLogin
+const (
+	PhaseAuthenticate   = "authenticate"
+	PhaseRoleResolution = "role_resolution"
+	PhaseSTS            = "sts"
+)
+
+// Metrics receives the login timings and outcomes, e.g. to feed Prometheus histograms and counters
+type Metrics interface {
+	// ObserveLogin records how long a phase of the login took
+	ObserveLogin(phase string, d time.Duration)
+	// IncResult counts a finished login
+	IncResult(success bool)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveLogin(string, time.Duration) {}
+
+func (noopMetrics) IncResult(bool) {}
+
+// metrics the configured Metrics, or one discarding everything
+func (opts *AWSLoginOptions) metrics() Metrics {
+	if opts.Metrics == nil {
+		return noopMetrics{}
+	}
+	return opts.Metrics
+}
+
+// observePhase reports the time elapsed since start for the phase
+func (opts *AWSLoginOptions) observePhase(phase string, start time.Time) {
+	opts.metrics().ObserveLogin(phase, time.Since(start))
+}
@@ -13,8 +13,10 @@ import (
 	"gocloak/util/samlHandler/aws/pkg/cfg"
 	"gocloak/util/samlHandler/aws/pkg/cookiejar"
 	"gocloak/util/samlHandler/aws/pkg/dump"
+	"gocloak/util/samlHandler/redact"
 
 	"github.com/avast/retry-go"
+	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/publicsuffix"
@@ -36,6 +38,7 @@ type HTTPClientOptions struct {
 	IsWithRetries bool //http retry feature switch
 	AttemptsCount uint
 	RetryDelay    time.Duration
+	CookieJarFile string // when set the cookies are loaded from and saved to this file
 }
 
 // NewDefaultTransport configure a transport with the TLS skip verify option
@@ -71,6 +74,15 @@ func BuildHttpClientOpts(account *cfg.IDPAccount) *HTTPClientOptions {
 		opts.RetryDelay = time.Duration(delay) * time.Second
 	}
 
+	if account.CookieJarFile != "" {
+		cookieJarFile, err := homedir.Expand(account.CookieJarFile)
+		if err != nil {
+			logrus.WithError(err).Warn("Unable to expand cookie jar file, IdP session cookies won't be persisted")
+		} else {
+			opts.CookieJarFile = cookieJarFile
+		}
+	}
+
 	return opts
 }
 
@@ -86,6 +98,13 @@ func NewHTTPClient(tr http.RoundTripper, opts *HTTPClientOptions) (*HTTPClient,
 		return nil, err
 	}
 
+	if opts != nil && opts.CookieJarFile != "" {
+		err = jar.Load(opts.CookieJarFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load cookie jar %s", opts.CookieJarFile)
+		}
+	}
+
 	client := http.Client{Transport: tr, Jar: jar}
 
 	return &HTTPClient{client, nil, opts}, nil
@@ -148,6 +167,20 @@ func (hc *HTTPClient) doWithRetry(req *http.Request) (*http.Response, error) {
 
 }
 
+// SaveCookieJar persists the cookies to the configured CookieJarFile, it does nothing without one
+func (hc *HTTPClient) SaveCookieJar() error {
+	if hc.Options == nil || hc.Options.CookieJarFile == "" {
+		return nil
+	}
+
+	jar, ok := hc.Jar.(*cookiejar.Jar)
+	if !ok {
+		return nil
+	}
+
+	return jar.Save(hc.Options.CookieJarFile)
+}
+
 // DisableFollowRedirect disable redirects
 func (hc *HTTPClient) DisableFollowRedirect() {
 	hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -160,13 +193,34 @@ func (hc *HTTPClient) EnableFollowRedirect() {
 	hc.CheckRedirect = nil
 }
 
+// StatusError a response with an unexpected status code, keeps the code so callers can tell a server failure
+// from a rejection
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request for url: %s failed status: %s", e.URL, e.Status)
+}
+
 // SuccessOrRedirectResponseValidator this validates the response code is within range of 200 - 399
 func SuccessOrRedirectResponseValidator(req *http.Request, resp *http.Response) error {
 	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
 		return nil
 	}
 
-	return errors.Errorf("request for url: %s failed status: %s", req.URL.String(), resp.Status)
+	return &StatusError{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// ServerErrorResponseValidator this validates the response code is below 500, leaving 4xx to the caller
+func ServerErrorResponseValidator(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode < 500 {
+		return nil
+	}
+
+	return &StatusError{URL: req.URL.String(), StatusCode: resp.StatusCode, Status: resp.Status}
 }
 
 // SuccessOrRedirectOrUnauthorizedResponseValidator also allows 401
@@ -189,7 +243,7 @@ func (hc *HTTPClient) logHTTPRequest(req *http.Request) {
 	}
 
 	logrus.WithField("http", "client").WithFields(logrus.Fields{
-		"URL":    req.URL.String(),
+		"URL":    redact.URL(req.URL.String()),
 		"method": req.Method,
 	}).Debug("HTTP Req")
 }
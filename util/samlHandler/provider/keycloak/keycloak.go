@@ -26,11 +26,20 @@ import (
 
 var logger = logrus.WithField("provider", "Keycloak")
 
+// ErrAccountLocked is returned when Keycloak temporarily locks the account out, e.g. after too many failed attempts
+var ErrAccountLocked = errors.New("account is temporarily locked")
+
+// ErrAccountDisabled is returned when the account is disabled in Keycloak, permanently locked out included
+var ErrAccountDisabled = errors.New("account is disabled")
+
 // Client wrapper around KeyCloak.
 type Client struct {
 	provider.ValidateBase
 
 	client *provider.HTTPClient
+
+	// MFATokenProvider collects the MFA token when the IdP asks for one, instead of prompting on the terminal
+	MFATokenProvider func() (string, error)
 }
 
 type authContext struct {
@@ -41,9 +50,12 @@ type authContext struct {
 
 // New create a new KeyCloakClient
 func New(idpAccount *cfg.IDPAccount) (*Client, error) {
+	return NewWithTransport(idpAccount, provider.NewDefaultTransport(idpAccount.SkipVerify))
+}
 
-	tr := provider.NewDefaultTransport(idpAccount.SkipVerify)
-
+// NewWithTransport create a new KeyCloakClient sending its requests through tr, e.g. to go through a proxy
+// or trust a custom CA. The client keeps its own cookie jar.
+func NewWithTransport(idpAccount *cfg.IDPAccount, tr http.RoundTripper) (*Client, error) {
 	client, err := provider.NewHTTPClient(tr, provider.BuildHttpClientOpts(idpAccount))
 	if err != nil {
 		return nil, errors.Wrap(err, "error building http client")
@@ -56,7 +68,17 @@ func New(idpAccount *cfg.IDPAccount) (*Client, error) {
 
 // Authenticate logs into KeyCloak and returns a SAML response
 func (kc *Client) Authenticate(loginDetails *creds.LoginDetails) (string, error) {
-	return kc.doAuthenticate(&authContext{loginDetails.MFAToken, 0, true}, loginDetails)
+	samlResponse, err := kc.doAuthenticate(&authContext{loginDetails.MFAToken, 0, true}, loginDetails)
+	if err != nil {
+		return "", err
+	}
+
+	err = kc.client.SaveCookieJar()
+	if err != nil {
+		logger.WithError(err).Warn("unable to persist the IdP session cookies")
+	}
+
+	return samlResponse, nil
 }
 
 func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.LoginDetails) (string, error) {
@@ -65,6 +87,12 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 		return "", errors.Wrap(err, "error retrieving login form from idp")
 	}
 
+	// a still valid IdP session answers with the SAML response straight away, no login form to fill
+	if samlResponse := authForm.Get("SAMLResponse"); samlResponse != "" {
+		logger.Debug("Reusing the existing IdP session")
+		return samlResponse, nil
+	}
+
 	data, err := kc.postLoginForm(authSubmitURL, authForm)
 	if err != nil {
 		return "", fmt.Errorf("error submitting login form")
@@ -78,6 +106,10 @@ func (kc *Client) doAuthenticate(authCtx *authContext, loginDetails *creds.Login
 		return "", errors.Wrap(err, "error parsing document")
 	}
 
+	if err := accountStateError(doc); err != nil {
+		return "", err
+	}
+
 	if containsTotpForm(doc) {
 		totpSubmitURL, err := extractSubmitURL(doc)
 		if err != nil {
@@ -156,6 +188,11 @@ func (kc *Client) getLoginForm(loginDetails *creds.LoginDetails) (string, url.Va
 		return "", nil, errors.Wrap(err, "error retrieving form")
 	}
 
+	err = provider.ServerErrorResponseValidator(res.Request, res)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "error retrieving form")
+	}
+
 	doc, err := goquery.NewDocumentFromReader(res.Body)
 	if err != nil {
 		return "", nil, errors.Wrap(err, "failed to build document from response")
@@ -198,6 +235,11 @@ func (kc *Client) postLoginForm(authSubmitURL string, authForm url.Values) ([]by
 		return nil, errors.Wrap(err, "error retrieving login form")
 	}
 
+	err = provider.ServerErrorResponseValidator(req, res)
+	if err != nil {
+		return nil, errors.Wrap(err, "error retrieving login form")
+	}
+
 	data, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving body")
@@ -211,7 +253,15 @@ func (kc *Client) postTotpForm(authCtx *authContext, totpSubmitURL string, doc *
 	otpForm := url.Values{}
 
 	if authCtx.mfaToken == "" {
-		authCtx.mfaToken = prompter.RequestSecurityCode("000000")
+		if kc.MFATokenProvider != nil {
+			mfaToken, err := kc.MFATokenProvider()
+			if err != nil {
+				return nil, errors.Wrap(err, "error retrieving MFA token")
+			}
+			authCtx.mfaToken = mfaToken
+		} else {
+			authCtx.mfaToken = prompter.RequestSecurityCode("000000")
+		}
 	}
 
 	doc.Find("input").Each(func(i int, s *goquery.Selection) {
@@ -369,6 +419,27 @@ func passwordValid(doc *goquery.Document) bool {
 	return valid
 }
 
+// accountStateError ErrAccountLocked or ErrAccountDisabled when the login page reports the account as such, along
+// with the message of the page
+func accountStateError(doc *goquery.Document) error {
+	var err error
+	doc.Find("span#input-error, span.kc-feedback-text, #kc-error-message").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		text := strings.TrimSpace(s.Text())
+		lower := strings.ToLower(text)
+
+		switch {
+		case strings.Contains(lower, "temporarily disabled"), strings.Contains(lower, "temporarily locked"):
+			err = errors.Wrap(ErrAccountLocked, text)
+		case strings.Contains(lower, "account is disabled"), strings.Contains(lower, "permanently disabled"), strings.Contains(lower, "permanently locked"):
+			err = errors.Wrap(ErrAccountDisabled, text)
+		}
+
+		return err == nil
+	})
+
+	return err
+}
+
 func containsTotpForm(doc *goquery.Document) bool {
 	// search totp field at Keycloak < 8.0.1
 	totpIndex := doc.Find("input#totp").Index()
@@ -25,6 +25,7 @@ import (
 	"gocloak/util/samlHandler/aws/pkg/page"
 	"gocloak/util/samlHandler/aws/pkg/prompter"
 	"gocloak/util/samlHandler/provider"
+	"gocloak/util/samlHandler/redact"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/marshallbrekka/go-u2fhost"
@@ -149,7 +150,7 @@ type ctxKey string
 func (oc *Client) createSession(loginDetails *creds.LoginDetails, sessionToken string) (string, string, error) {
 	logger.Debug("create session func called")
 	if loginDetails == nil || sessionToken == "" {
-		logger.Debugf("unable to create an Okta session, nil input | loginDetails: %v | sessionToken: %s", loginDetails, sessionToken)
+		logger.WithField("loginDetails", redact.Value(loginDetails)).WithField("sessionToken", sessionToken).Debug("unable to create an Okta session, nil input")
 		return "", "", fmt.Errorf("unable to create an okta session, nil input")
 	}
 
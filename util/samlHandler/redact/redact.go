@@ -0,0 +1,229 @@
+// Package redact obscures secret-bearing values before they reach the logs
+package redact
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Placeholder replaces the redacted values
+const Placeholder = "[REDACTED]"
+
+var (
+	formattedType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	errorType     = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// sensitiveNames a field, key or query parameter whose normalized name contains one of these holds a secret
+var sensitiveNames = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"cookie",
+	"assertion",
+	"samlresponse",
+	"samlrequest",
+	"authorization",
+}
+
+// sensitiveExactNames a field, key or query parameter whose normalized name is one of these holds a secret, the
+// OAuth authorization code and the Keycloak session code without catching status_code and the like
+var sensitiveExactNames = []string{
+	"code",
+	"sessioncode",
+}
+
+// IsSensitive whether a field, key or query parameter of that name holds a secret
+func IsSensitive(name string) bool {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' || r == ' ' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+
+	for _, sensitive := range sensitiveNames {
+		if strings.Contains(normalized, sensitive) {
+			return true
+		}
+	}
+
+	for _, sensitive := range sensitiveExactNames {
+		if normalized == sensitive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Value returns v ready to be logged: structs, and pointers to them, become a map of their exported fields
+// with the secret-bearing ones obscured, maps get their secret-bearing keys obscured. Other values are
+// returned as is.
+func Value(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	return value(reflect.ValueOf(v))
+}
+
+func value(rv reflect.Value) interface{} {
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().Implements(formattedType) {
+			return rv.Interface()
+		}
+		rv = rv.Elem()
+	}
+
+	// values rendering themselves, like time.Time or errors, are kept as they are
+	if rv.Type().Implements(formattedType) || rv.Type().Implements(errorType) {
+		return rv.Interface()
+	}
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		fields := make(map[string]interface{}, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fields[field.Name] = redactField(field.Name, rv.Field(i))
+		}
+		return fields
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return rv.Interface()
+		}
+		entries := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			entries[iter.Key().String()] = redactField(iter.Key().String(), iter.Value())
+		}
+		return entries
+	}
+
+	return rv.Interface()
+}
+
+func redactField(name string, rv reflect.Value) interface{} {
+	if IsSensitive(name) {
+		if rv.IsZero() {
+			return ""
+		}
+		return Placeholder
+	}
+
+	return value(rv)
+}
+
+// URL returns the URL with the values of its secret-bearing query parameters obscured
+func URL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" {
+		return rawURL
+	}
+
+	query := u.Query()
+	for name := range query {
+		if IsSensitive(name) {
+			query.Set(name, Placeholder)
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+var (
+	// samlParameter a SAML message sent as a form or query parameter, e.g. the SAMLAssertion of an STS request
+	samlParameter = regexp.MustCompile(`(?i)(SAML(Assertion|Response|Request)=)[^&\s"]+`)
+
+	// codeParameter the OAuth or Keycloak session code sent as a query parameter
+	codeParameter = regexp.MustCompile(`(?i)([?&](session_)?code=)[^&\s"]+`)
+
+	// secretAssignment a secret spelled out as name=value or name: value, e.g. in an error quoting a request
+	secretAssignment = regexp.MustCompile(`(?i)((password|passwd|secret|token|cookie|authorization)["']?\s*[:=]\s*["']?((Bearer|Basic)\s+)?)[^\s&"',;]+`)
+
+	// encodedSAML a base64 encoded SAML message, e.g. an assertion quoted in an error
+	encodedSAML = regexp.MustCompile(`\b(PD94bWw|PHNhbW)[A-Za-z0-9+/]{16,}={0,2}`)
+)
+
+// String returns s with the secrets, raw or URL encoded, and any SAML message, code parameter or secret spelled
+// out as name=value obscured
+func String(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, Placeholder)
+		if escaped := url.QueryEscape(secret); escaped != secret {
+			s = strings.ReplaceAll(s, escaped, Placeholder)
+		}
+	}
+
+	s = samlParameter.ReplaceAllString(s, "${1}"+Placeholder)
+	s = codeParameter.ReplaceAllString(s, "${1}"+Placeholder)
+	s = secretAssignment.ReplaceAllString(s, "${1}"+Placeholder)
+	return encodedSAML.ReplaceAllString(s, Placeholder)
+}
+
+// redactedError an error whose message went through String, the original stays reachable for errors.Is and errors.As
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// Error returns err with the secrets obscured from its message, see String. A nil err stays nil.
+func Error(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	return &redactedError{err: err, msg: String(err.Error(), secrets...)}
+}
+
+// Hook obscures the secret-bearing fields of every log entry, and the secrets String finds in its error
+type Hook struct{}
+
+// Levels implements logrus.Hook
+func (Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (Hook) Fire(entry *logrus.Entry) error {
+	for key, v := range entry.Data {
+		if key == logrus.ErrorKey {
+			if err, ok := v.(error); ok {
+				entry.Data[key] = Error(err)
+				continue
+			}
+		}
+		if IsSensitive(key) {
+			entry.Data[key] = Placeholder
+			continue
+		}
+		entry.Data[key] = Value(v)
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package redact
+
+import (
+	"bytes"
+	"testing"
+
+	"gocloak/util/samlHandler/aws/pkg/creds"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookKeepsSecretsOutOfDebugOutput(t *testing.T) {
+	var out bytes.Buffer
+
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.AddHook(Hook{})
+
+	loginDetails := &creds.LoginDetails{
+		Username:          "alice",
+		Password:          "hunter2-password",
+		MFAToken:          "123456",
+		ClientSecret:      "client-secret-value",
+		OktaSessionCookie: "cookie-value",
+		URL:               "https://idp.example.com/auth",
+	}
+
+	logger.WithField("loginDetails", loginDetails).Debug("login details")
+	logger.WithField("password", "plain-password").Debug("password field")
+	logger.WithField("saml-response", "PHNhbWxwOlJlc3BvbnNlPg==").Debug("SAML response")
+	logger.WithField("URL", URL("https://idp.example.com/login?SAMLRequest=saml-request-value&session_code=code-value&client_id=app")).Debug("HTTP Req")
+
+	logged := out.String()
+	for _, secret := range []string{"hunter2-password", "123456", "client-secret-value", "cookie-value", "plain-password", "PHNhbWxwOlJlc3BvbnNlPg==", "saml-request-value", "code-value"} {
+		assert.NotContains(t, logged, secret)
+	}
+
+	assert.Contains(t, logged, "alice")
+	assert.Contains(t, logged, "https://idp.example.com/auth")
+	assert.Contains(t, logged, "client_id=app")
+	assert.Contains(t, logged, Placeholder)
+}
+
+func TestIsSensitive(t *testing.T) {
+	for _, name := range []string{"Password", "MFAToken", "ClientSecret", "OktaSessionCookie", "saml-response", "SAMLRequest", "session_code"} {
+		assert.True(t, IsSensitive(name), name)
+	}
+
+	for _, name := range []string{"Username", "URL", "RoleARN", "Region", "SessionDuration", "status_code", "error_code", "codeVerifierMethod"} {
+		assert.False(t, IsSensitive(name), name)
+	}
+}
+
+func TestString(t *testing.T) {
+	assert.Equal(t, "token [REDACTED] and [REDACTED] again", String("token abc+/= and abc%2B%2F%3D again", "abc+/="))
+	assert.Equal(t, "Action=AssumeRoleWithSAML&SAMLAssertion=[REDACTED]&Version=2011-06-15",
+		String("Action=AssumeRoleWithSAML&SAMLAssertion=PHNhbWw+&Version=2011-06-15"))
+	assert.Equal(t, "nothing to hide", String("nothing to hide", ""))
+	assert.Equal(t, `login failed: password="[REDACTED]", Authorization: Bearer [REDACTED]`,
+		String(`login failed: password="hunter2", Authorization: Bearer eyJhbGciOi`))
+	assert.Equal(t, "GET https://idp.example.com/cb?state=abc&code=[REDACTED] status_code=400",
+		String("GET https://idp.example.com/cb?state=abc&code=auth-code status_code=400"))
+	assert.Equal(t, "unable to parse [REDACTED]", String("unable to parse PHNhbWxwOlJlc3BvbnNlIHhtbG5zOnNhbWxwPQ=="))
+}
+
+func TestHookRedactsErrors(t *testing.T) {
+	var out bytes.Buffer
+
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.AddHook(Hook{})
+
+	err := errors.Wrap(errors.New("password=hunter2 rejected"), "login failed")
+	logger.WithError(err).WithField("status_code", 401).Error("login")
+
+	logged := out.String()
+	assert.NotContains(t, logged, "hunter2")
+	assert.Contains(t, logged, "login failed: password=[REDACTED] rejected")
+	assert.Contains(t, logged, "status_code=401")
+}
@@ -1,13 +1,20 @@
 package samllogin
 
 import (
+	"context"
 	b64 "encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	//common
 	"gocloak/util/samlHandler/provider/keycloak"
+	"gocloak/util/samlHandler/redact"
 
 	// ***** aws *****
 	saml2aws "gocloak/util/samlHandler/aws/pkg"
@@ -29,40 +36,748 @@ import (
 	//ali-sdk
 	alists "github.com/aliyun/alibaba-cloud-sdk-go/services/sts"
 
+	"github.com/AlecAivazis/survey/v2/terminal"
+	"github.com/avast/retry-go"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
+const (
+	// DefaultRolePromptAttempts how many invalid answers the role prompt takes before giving up
+	DefaultRolePromptAttempts = 3
+
+	// rolePromptRetryDelay the base delay before the role prompt is shown again
+	rolePromptRetryDelay = 100 * time.Millisecond
+)
+
+// ErrNoRolesAvailable returned when the SAML assertion doesn't grant any role to assume
+var ErrNoRolesAvailable = errors.New("no roles available to assume")
+
+// ErrNoRoleAttribute is returned when the assertion has no AWS Role attribute, the IdP client lacks the role mapper
+var ErrNoRoleAttribute = errors.New("SAML assertion has no AWS Role attribute, check the role mappers of the IdP client")
+
+// ErrEmptyRoleAttribute is returned when the AWS Role attribute has no values, the user isn't granted any AWS role
+var ErrEmptyRoleAttribute = errors.New("AWS Role attribute of the SAML assertion is empty, the user isn't granted any AWS role")
+
+// NoRolesError the assertion grants no role. Err is ErrNoRoleAttribute or ErrEmptyRoleAttribute, telling a
+// mapping misconfiguration from missing permissions. It also matches ErrNoRolesAvailable.
+type NoRolesError struct {
+	Err    error
+	Issuer string
+}
+
+func (e *NoRolesError) Error() string {
+	if e.Issuer == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("%v (issuer %s)", e.Err, e.Issuer)
+}
+
+// Unwrap returns ErrNoRoleAttribute or ErrEmptyRoleAttribute
+func (e *NoRolesError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrNoRolesAvailable
+func (e *NoRolesError) Is(target error) bool {
+	return target == ErrNoRolesAvailable
+}
+
+// noRolesError the NoRolesError explaining why the assertion grants no role
+func noRolesError(data []byte) error {
+	issuer, err := saml2aws.ExtractIssuer(data)
+	if err != nil {
+		logger.WithError(err).Debug("Unable to read the issuer of the SAML assertion.")
+	}
+
+	noRolesErr := &NoRolesError{Err: ErrEmptyRoleAttribute, Issuer: issuer}
+	if present, err := saml2aws.HasAwsRoleAttribute(data); err == nil && !present {
+		noRolesErr.Err = ErrNoRoleAttribute
+	}
+
+	return noRolesErr
+}
+
+// nonBlank the values that aren't blank
+func nonBlank(values []string) []string {
+	kept := values[:0:0]
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			kept = append(kept, value)
+		}
+	}
+
+	return kept
+}
+
+// ErrRoleSelectionRequired is returned in non-interactive mode when several roles are available and none is configured
+var ErrRoleSelectionRequired = errors.New("several roles available, configure role_arn, a role filter or a role index to select one")
+
+// ErrRoleSelectionAborted is returned when the role prompt is closed, e.g. stdin reached EOF or the user hit ctrl-c
+var ErrRoleSelectionAborted = errors.New("role selection aborted")
+
+// ErrAssertionExpired is returned when the SAML assertion is no longer valid by the time it reaches STS
+var ErrAssertionExpired = errors.New("SAML assertion has expired, please re-authenticate")
+
 // //////// AWS START
 func LoginAWS(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) (*awsconfig.AWSCredentials, error) {
-	fmt.Println("provider start")
-	provider, err := keycloak.New(account)
+	return LoginAWSWithContext(context.Background(), account, loginDetails)
+}
+
+// LoginAWSByAccountName loads the named idp account from the saml2aws configuration file, ~/.saml2aws,
+// and logs into it like LoginAWS.
+func LoginAWSByAccountName(name string, loginDetails *awscreds.LoginDetails) (*awsconfig.AWSCredentials, error) {
+	return LoginAWSByAccountNameWithOptions(context.Background(), name, loginDetails, nil)
+}
+
+// LoginAWSByAccountNameWithOptions loads the named idp account from the saml2aws configuration file at
+// opts.ConfigPath, ~/.saml2aws by default, and logs into it like LoginAWSWithOptions.
+func LoginAWSByAccountNameWithOptions(ctx context.Context, name string, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	configPath := ""
+	if opts != nil {
+		configPath = opts.ConfigPath
+	}
+
+	account, err := loadIDPAccountAWS(configPath, name)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error building IdP client.")
+		return nil, err
 	}
-	fmt.Println("provider end")
 
-	fmt.Println("samlAssertion start")
-	var samlAssertion string
-	samlAssertion, err = provider.Authenticate(loginDetails)
+	return LoginAWSWithOptions(ctx, account, loginDetails, opts)
+}
+
+// loadIDPAccountAWS the named idp account of the saml2aws configuration file at configPath, the default one when
+// empty. LoadIDPAccount alone hands out an empty account for unknown names.
+func loadIDPAccountAWS(configPath, name string) (*awscfg.IDPAccount, error) {
+	configManager, err := awscfg.NewConfigManager(configPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error authenticating to IdP.")
+		return nil, errors.Wrap(err, "Error loading the saml2aws configuration.")
 	}
-	fmt.Println("samlAssertion end")
 
-	role, err := selectRoleAWS(samlAssertion, account)
+	names, err := configManager.IDPAccountNames()
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
+		return nil, errors.Wrap(err, "Error loading the saml2aws configuration.")
+	}
+
+	found := false
+	for _, n := range names {
+		if n == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.Wrapf(awscfg.ErrIdpAccountNotFound, "IDP account %q not found, available accounts: [%s]", name, strings.Join(names, ", "))
 	}
 
-	awsCreds, err := loginToStsUsingRoleALIAWS(account, role, samlAssertion)
+	return configManager.LoadIDPAccount(name)
+}
+
+// LoginAWSWithContext runs the same flow as LoginAWS, aborting as soon as ctx is cancelled or times out.
+func LoginAWSWithContext(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) (*awsconfig.AWSCredentials, error) {
+	return LoginAWSWithOptions(ctx, account, loginDetails, nil)
+}
+
+// LoginAWSWithOptions runs the AWS login flow tuned by opts, a nil opts behaves like LoginAWSWithContext.
+func LoginAWSWithOptions(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	result, err := LoginAWSWithResult(ctx, account, loginDetails, opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error logging into AWS role using SAML assertion.")
+		return nil, err
+	}
+
+	return result.Credentials, nil
+}
+
+// RefreshAWS returns awsCreds as long as they are valid for longer than within, otherwise it logs in again
+// bypassing the cache. Long lived processes can call it on a ticker without hitting the IdP every time.
+func RefreshAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, awsCreds *awsconfig.AWSCredentials, within time.Duration, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	refreshOpts := AWSLoginOptions{}
+	if opts != nil {
+		refreshOpts = *opts
+	}
+	refreshOpts.ForceRefresh = true
+
+	if !awsCreds.IsExpiringAt(refreshOpts.now(), within) {
+		return awsCreds, nil
+	}
+
+	if awsCreds != nil {
+		logger.WithField("expires", awsCreds.Expires).Debug("Credentials expiring, logging in again.")
+	}
+
+	return LoginAWSWithOptions(ctx, account, loginDetails, &refreshOpts)
+}
+
+// LoginResult the outcome of an AWS login
+type LoginResult struct {
+	Credentials *awsconfig.AWSCredentials
+	// Assertion the base64 encoded SAML assertion sent by the IdP, empty when the credentials came from the cache
+	Assertion string
+	// Role the assumed role, nil when the credentials came from the cache
+	Role *saml2aws.AWSRole
+	// RoleSessionName the session name AWS derived for the assumed role, as found in the principal ARN
+	RoleSessionName string
+	// SessionTags the principal tags the IdP attached to the session, nil when the credentials came from the cache
+	SessionTags map[string]string
+	// TransitiveTagKeys the session tags the IdP marked as transitive, kept when chaining roles
+	TransitiveTagKeys []string
+	// STSResponse the metadata of the AssumeRoleWithSAML response, nil when the credentials came from the cache
+	STSResponse *STSResponseMetadata
+}
+
+// LoginAWSWithResult runs the same flow as LoginAWSWithOptions and also returns the SAML assertion and the assumed role
+func LoginAWSWithResult(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (result *LoginResult, err error) {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	defer func() {
+		opts.metrics().IncResult(err == nil)
+	}()
+
+	ctx, cancel := withPhaseTimeout(ctx, opts.LoginTimeout, 0)
+	defer cancel()
+
+	cachedCreds, err := cachedLoginAWS(account, opts)
+	if err != nil {
+		return nil, err
+	}
+	if cachedCreds != nil {
+		return &LoginResult{
+			Credentials:     cachedCreds,
+			RoleSessionName: saml2aws.ExtractSessionName(cachedCreds.PrincipalARN),
+		}, nil
+	}
+
+	if opts.Preflight {
+		if err := preflightAWS(ctx, account, loginDetails, opts); err != nil {
+			return nil, newLoginError(ErrPreflight, err, "")
+		}
+	}
+
+	samlAssertion, role, err := authenticateAndSelectRoleAWS(ctx, account, loginDetails, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	stsCtx, stsResponse := withSTSMetadata(ctx)
+	awsCreds, err := requestCredentialsAWS(stsCtx, account, role, samlAssertion, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	roleSessionName := saml2aws.ExtractSessionName(awsCreds.PrincipalARN)
+	logger.WithFields(logrus.Fields{
+		"principal":    awsCreds.PrincipalARN,
+		"session_name": roleSessionName,
+		"region":       awsCreds.Region,
+		"validity":     describeValidity(awsCreds, opts.now()),
+	}).Info("Assumed AWS role.")
+
+	if err := writeCredentialsFileAWS(account, awsCreds, opts); err != nil {
+		return nil, err
+	}
+
+	sessionTags, transitiveTagKeys := extractSessionTags(samlAssertion)
+
+	return &LoginResult{
+		Credentials:       awsCreds,
+		Assertion:         samlAssertion,
+		Role:              role,
+		RoleSessionName:   roleSessionName,
+		SessionTags:       sessionTags,
+		TransitiveTagKeys: transitiveTagKeys,
+		STSResponse:       stsResponse,
+	}, nil
+}
+
+// cachedLoginAWS the cached credentials of the account, saved into the credentials file when asked to, or nil when
+// the login has to go to the IdP
+func cachedLoginAWS(account *awscfg.IDPAccount, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if opts.ForceRefresh || opts.NoCache {
+		return nil, nil
+	}
+
+	cachedCreds, err := loadCachedCredentials(account, opts)
+	if err != nil {
+		logger.WithError(err).Warn("Ignoring credentials cache.")
+		return nil, nil
+	}
+	if cachedCreds == nil {
+		return nil, nil
+	}
+
+	logger.WithField("validity", describeValidity(cachedCreds, opts.now())).Info("Using cached AWS credentials.")
+	if err := writeCredentialsFileAWS(account, cachedCreds, opts); err != nil {
+		return nil, err
+	}
+
+	return cachedCreds, nil
+}
+
+// writeCredentialsFileAWS saves the credentials into the profile of the account when opts.WriteCredentialsFile
+// asks for it
+func writeCredentialsFileAWS(account *awscfg.IDPAccount, awsCreds *awsconfig.AWSCredentials, opts *AWSLoginOptions) error {
+	if !opts.WriteCredentialsFile {
+		return nil
+	}
+
+	if err := WriteToCredentialsFile(awsCreds, account.Profile); err != nil {
+		return errors.Wrap(err, "Error writing the AWS credentials file.")
+	}
+	logger.WithField("profile", account.Profile).Info("Saved AWS credentials.")
+
+	return nil
+}
+
+// describeValidity how long the credentials remain valid from now, e.g. "credentials valid for 11h59m until 2024-01-02 03:04 UTC"
+func describeValidity(awsCreds *awsconfig.AWSCredentials, now time.Time) string {
+	if awsCreds.Expires.IsZero() {
+		return "credentials expiry unknown"
+	}
+
+	until := awsCreds.Expires.UTC().Format("2006-01-02 15:04 MST")
+
+	ttl := awsCreds.TTLAt(now).Round(time.Minute)
+	if ttl <= 0 {
+		return "credentials expired at " + until
+	}
+
+	hours := int(ttl / time.Hour)
+	minutes := int((ttl % time.Hour) / time.Minute)
+	if hours == 0 {
+		return fmt.Sprintf("credentials valid for %dm until %s", minutes, until)
+	}
+
+	return fmt.Sprintf("credentials valid for %dh%02dm until %s", hours, minutes, until)
+}
+
+// extractSessionTags the session tags and transitive tag keys of the assertion, the tags are informational
+// so a malformed assertion only gets logged
+func extractSessionTags(samlAssertion string) (map[string]string, []string) {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to decode SAML assertion for session tags.")
+		return nil, nil
+	}
+
+	sessionTags, err := saml2aws.ExtractSessionTags(data)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to extract session tags from SAML assertion.")
+		return nil, nil
+	}
+
+	transitiveTagKeys, err := saml2aws.ExtractTransitiveTagKeys(data)
+	if err != nil {
+		logger.WithError(err).Warn("Unable to extract transitive tag keys from SAML assertion.")
+		return sessionTags, nil
+	}
+
+	return sessionTags, transitiveTagKeys
+}
+
+// requestCredentialsAWS exchanges the SAML assertion for credentials of the role, assumes the chained role
+// if any, and caches the outcome
+func requestCredentialsAWS(ctx context.Context, account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "Login cancelled before requesting AWS credentials.")
+	}
+
+	ctx, cancel := withPhaseTimeout(ctx, opts.STSTimeout, DefaultSTSTimeout)
+	defer cancel()
+
+	// the cache is keyed on the account as configured, not on the regions derived from it below
+	cacheAccount := account
+	account = withRoleRegion(account, role, opts)
+	account = withDestinationRegion(account, samlAssertion)
+
+	if err := validateSessionPolicy(opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Partition != "" || opts.CheckClockSkew {
+		region, err := resolveRegion(account.Region)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Partition != "" {
+			if err := validatePartition(opts.Partition, region, role); err != nil {
+				return nil, err
+			}
+		}
+
+		if opts.CheckClockSkew {
+			if err := checkClockSkew(ctx, opts.HTTPClient, clockSkewURL(region, opts)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	stsStart := time.Now()
+	awsCreds, err := loginToStsWithFallbackAWS(ctx, account, role, samlAssertion, opts)
+	opts.observePhase(PhaseSTS, stsStart)
+	if err != nil {
+		return nil, newLoginError(ErrSTS, err, "Error logging into AWS role using SAML assertion.")
+	}
+
+	if opts.ChainRoleARN != "" {
+		awsCreds, err = assumeChainedRole(ctx, account, awsCreds, opts)
+		if err != nil {
+			return nil, newLoginError(ErrSTS, err, "")
+		}
+	}
+
+	if !opts.NoCache {
+		if err := saveCachedCredentials(cacheAccount, role.RoleARN, opts, awsCreds); err != nil {
+			logger.WithError(err).Warn("Unable to cache AWS credentials.")
+		}
 	}
 
 	return awsCreds, nil
 }
 
-func selectRoleAWS(samlAssertion string, account *awscfg.IDPAccount) (*saml2aws.AWSRole, error) {
+// LoginPreview what a login would assume, as resolved by DryRunLoginAWS
+type LoginPreview struct {
+	RoleARN      string
+	PrincipalARN string
+	AccountID    string
+}
+
+// DryRunLoginAWS authenticates to the IdP and resolves the role like LoginAWSWithOptions,
+// but stops short of requesting credentials from STS and returns what would have been assumed.
+func DryRunLoginAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (*LoginPreview, error) {
+	if opts == nil {
+		opts = &AWSLoginOptions{}
+	}
+
+	_, role, err := authenticateAndSelectRoleAWS(ctx, account, loginDetails, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginPreview{
+		RoleARN:      role.RoleARN,
+		PrincipalARN: role.PrincipalARN,
+		AccountID:    saml2aws.ExtractAccountID(role.RoleARN),
+	}, nil
+}
+
+// ListRolesAWS authenticates to the IdP and returns every role the assertion grants, with their principal,
+// sorted by account then role name. Nothing is prompted and no credentials are requested from STS.
+func ListRolesAWS(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) ([]*saml2aws.AWSRole, error) {
+	awsAccounts, err := fetchAWSAccounts(account, loginDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	return saml2aws.AccountRoles(awsAccounts), nil
+}
+
+// roleListEntry an entry of the array written by ListRolesJSONAWS
+type roleListEntry struct {
+	Account      string `json:"account"`
+	AccountAlias string `json:"accountAlias"`
+	RoleARN      string `json:"roleArn"`
+	PrincipalARN string `json:"principalArn"`
+}
+
+// ListRolesJSONAWS returns the roles of ListRolesAWS as a JSON array of {account, accountAlias, roleArn,
+// principalArn} objects, in the same order, for scripts to jq over
+func ListRolesJSONAWS(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) (string, error) {
+	awsAccounts, err := fetchAWSAccounts(account, loginDetails)
+	if err != nil {
+		return "", err
+	}
+
+	return rolesToJSON(awsAccounts)
+}
+
+// rolesToJSON renders the roles of the sorted accounts for ListRolesJSONAWS
+func rolesToJSON(awsAccounts []*saml2aws.AWSAccount) (string, error) {
+	entries := []roleListEntry{}
+	for _, awsAccount := range awsAccounts {
+		alias, accountID := saml2aws.AccountAlias(awsAccount.Name)
+		for _, awsRole := range awsAccount.Roles {
+			id := accountID
+			if id == "" {
+				id = saml2aws.ExtractAccountID(awsRole.RoleARN)
+			}
+			entries = append(entries, roleListEntry{
+				Account:      id,
+				AccountAlias: alias,
+				RoleARN:      awsRole.RoleARN,
+				PrincipalARN: awsRole.PrincipalARN,
+			})
+		}
+	}
+
+	p, err := json.Marshal(entries)
+	if err != nil {
+		return "", errors.Wrap(err, "Error marshalling the roles.")
+	}
+
+	return string(p), nil
+}
+
+// AccountSummary an AWS account the assertion grants at least one role in
+type AccountSummary struct {
+	ID    string
+	Alias string
+}
+
+// ListAccountsAWS authenticates to the IdP and returns every AWS account the assertion grants a role in,
+// once each and sorted by name. Nothing is prompted and no credentials are requested from STS.
+func ListAccountsAWS(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) ([]AccountSummary, error) {
+	awsAccounts, err := fetchAWSAccounts(account, loginDetails)
+	if err != nil {
+		return nil, err
+	}
+
+	return summarizeAccounts(awsAccounts), nil
+}
+
+// summarizeAccounts the ID and alias of the accounts, an account listed twice is only kept the first time
+func summarizeAccounts(awsAccounts []*saml2aws.AWSAccount) []AccountSummary {
+	summaries := []AccountSummary{}
+	seen := map[string]bool{}
+	for _, awsAccount := range awsAccounts {
+		alias, accountID := saml2aws.AccountAlias(awsAccount.Name)
+		if accountID == "" && len(awsAccount.Roles) > 0 {
+			accountID = saml2aws.ExtractAccountID(awsAccount.Roles[0].RoleARN)
+		}
+
+		key := accountID
+		if key == "" {
+			key = alias
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		summaries = append(summaries, AccountSummary{ID: accountID, Alias: alias})
+	}
+
+	return summaries
+}
+
+// fetchAWSAccounts authenticates to the IdP and returns the accounts and roles the assertion grants, sorted
+func fetchAWSAccounts(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) ([]*saml2aws.AWSAccount, error) {
+	samlAssertion, err := authenticateToIdPAWS(context.Background(), account, loginDetails, &AWSLoginOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	awsRoles, err := extractAWSRoles(samlAssertion)
+	if err != nil {
+		return nil, err
+	}
+
+	awsAccounts, err := parseAWSAccounts(samlAssertion, awsRoles, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	saml2aws.SortAccounts(awsAccounts)
+
+	return awsAccounts, nil
+}
+
+// authenticateAndSelectRoleAWS gets the SAML assertion from the IdP and picks the role to assume from it
+func authenticateAndSelectRoleAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (string, *saml2aws.AWSRole, error) {
+	authCtx, cancel := withPhaseTimeout(ctx, opts.AuthenticateTimeout, DefaultAuthenticateTimeout)
+	defer cancel()
+
+	authStart := time.Now()
+	samlAssertion, err := authenticateToIdPAWS(authCtx, account, loginDetails, opts)
+	opts.observePhase(PhaseAuthenticate, authStart)
+	if err != nil {
+		return "", nil, err
+	}
+
+	roleStart := time.Now()
+	role, err := selectRoleAWS(samlAssertion, account, opts)
+	opts.observePhase(PhaseRoleResolution, roleStart)
+	if err != nil {
+		return "", nil, newLoginError(ErrRoleSelection, err, "Failed to assume role. Please check whether you are permitted to assume the given role for the AWS service.")
+	}
+
+	return samlAssertion, role, nil
+}
+
+// authenticateToIdPAWS builds the IdP client and returns the SAML assertion it hands out
+func authenticateToIdPAWS(ctx context.Context, account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails, opts *AWSLoginOptions) (string, error) {
+	if err := validateLoginAWS(account, loginDetails); err != nil {
+		return "", newLoginError(ErrValidateLogin, err, "Invalid login details.")
+	}
+
+	loginDetails, err := withStoredPassword(account, loginDetails, opts)
+	if err != nil {
+		return "", newLoginError(ErrValidateLogin, err, "Invalid login details.")
+	}
+
+	logger.Debug("Building IdP client.")
+	provider, err := newSAMLProvider(account, opts)
+	if err != nil {
+		return "", newLoginError(ErrBuildProvider, err, "Error building IdP client.")
+	}
+	provider = withIdPRetry(ctx, provider, opts)
+
+	if err := provider.Validate(loginDetails); err != nil {
+		return "", newLoginError(ErrValidateLogin, err, "Invalid login details.")
+	}
+
+	logger.WithField("username", loginDetails.Username).Info("Authenticating to IdP.")
+	samlAssertion, err := authenticateAWS(ctx, provider, loginDetails)
+	if err != nil {
+		return "", newLoginError(ErrAuthenticate, err, authenticateErrorMessage(err))
+	}
+
+	return samlAssertion, nil
+}
+
+// authenticateErrorMessage tells the user a locked or disabled account apart from any other authentication failure
+func authenticateErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrAccountLocked):
+		return "IdP account is temporarily locked, retry later or ask an administrator to unlock it."
+	case errors.Is(err, ErrAccountDisabled):
+		return "IdP account is disabled, contact an administrator."
+	}
+
+	return "Error authenticating to IdP."
+}
+
+// validateLoginAWS checks the account and login details before reaching out to the IdP
+func validateLoginAWS(account *awscfg.IDPAccount, loginDetails *awscreds.LoginDetails) error {
+	if err := account.Validate(); err != nil {
+		return err
+	}
+
+	if loginDetails == nil {
+		return errors.New("No login details.")
+	}
+
+	return nil
+}
+
+// newSAMLProvider the IdP client of the account, Keycloak unless opts.NewSAMLProvider says otherwise
+func newSAMLProvider(account *awscfg.IDPAccount, opts *AWSLoginOptions) (saml2aws.SAMLClient, error) {
+	if opts.NewSAMLProvider != nil {
+		return opts.NewSAMLProvider(account)
+	}
+
+	var provider *keycloak.Client
+	var err error
+	if opts.HTTPClient != nil {
+		provider, err = keycloak.NewWithTransport(account, httpTransport(opts.HTTPClient))
+	} else {
+		provider, err = keycloak.New(account)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider.MFATokenProvider = opts.MFATokenProvider
+
+	return provider, nil
+}
+
+// authenticateAWS runs the provider authentication, which has no context support of its own,
+// and returns early with the context error when ctx is done first.
+func authenticateAWS(ctx context.Context, provider saml2aws.SAMLClient, loginDetails *awscreds.LoginDetails) (string, error) {
+	type authResult struct {
+		samlAssertion string
+		err           error
+	}
+
+	done := make(chan authResult, 1)
+	go func() {
+		samlAssertion, err := provider.Authenticate(loginDetails)
+		done <- authResult{samlAssertion, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", errors.Wrap(ctx.Err(), "Authentication cancelled.")
+	case res := <-done:
+		return res.samlAssertion, res.err
+	}
+}
+
+func selectRoleAWS(samlAssertion string, account *awscfg.IDPAccount, opts *AWSLoginOptions) (*saml2aws.AWSRole, error) {
+	logAssertionOrigin(samlAssertion)
+
+	if opts.DebugRoles {
+		if err := dumpRolesAWS(os.Stderr, samlAssertion, opts.HTTPClient); err != nil {
+			logger.WithError(err).Warn("Unable to dump the roles of the SAML assertion.")
+		}
+	}
+
+	awsRoles, err := extractAWSRoles(samlAssertion)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := resolveRoleALIAWS(awsRoles, samlAssertion, account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkAssertionExpiry(samlAssertion, opts.now()); err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+// logAssertionOrigin logs the issuer and destination of the assertion, an audit trail of the IdP realm actually used
+func logAssertionOrigin(samlAssertion string) {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return
+	}
+
+	issuer, err := saml2aws.ExtractIssuer(data)
+	if err != nil {
+		logger.WithError(err).Debug("Unable to read the issuer of the SAML assertion.")
+	}
+
+	destination, err := saml2aws.ExtractDestinationURL(data)
+	if err != nil {
+		logger.WithError(err).Debug("Unable to read the destination of the SAML assertion.")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"issuer":      issuer,
+		"destination": destination,
+	}).Info("Authenticating against SAML issuer.")
+}
+
+// checkAssertionExpiry returns ErrAssertionExpired once the NotOnOrAfter of the assertion has passed at now
+func checkAssertionExpiry(samlAssertion string, now time.Time) error {
+	data, err := b64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return errors.Wrap(err, "Error decoding SAML assertion.")
+	}
+
+	notOnOrAfter, err := saml2aws.ExtractMFATokenExpiryTime(data)
+	if err != nil {
+		// not every IdP sets NotOnOrAfter, STS remains the judge then
+		logger.WithError(err).Debug("Unable to read the validity of the SAML assertion.")
+		return nil
+	}
+
+	if !now.Before(notOnOrAfter) {
+		return ErrAssertionExpired
+	}
+
+	return nil
+}
+
+// extractAWSRoles decodes the assertion and parses the roles it grants
+func extractAWSRoles(samlAssertion string) ([]*saml2aws.AWSRole, error) {
 	data, err := b64.StdEncoding.DecodeString(samlAssertion)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
@@ -73,10 +788,9 @@ func selectRoleAWS(samlAssertion string, account *awscfg.IDPAccount) (*saml2aws.
 		return nil, errors.Wrap(err, "Error parsing AWS roles.")
 	}
 
+	roles = nonBlank(roles)
 	if len(roles) == 0 {
-		log.Println("No roles to assume.")
-		log.Println("Please check you are permitted to assume roles for the AWS service.")
-		os.Exit(1)
+		return nil, noRolesError(data)
 	}
 
 	awsRoles, err := saml2aws.ParseAWSRoles(roles)
@@ -84,21 +798,12 @@ func selectRoleAWS(samlAssertion string, account *awscfg.IDPAccount) (*saml2aws.
 		return nil, errors.Wrap(err, "Error parsing AWS roles.")
 	}
 
-	return resolveRoleALIAWS(awsRoles, samlAssertion, account)
+	return awsRoles, nil
 }
 
-func resolveRoleALIAWS(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *awscfg.IDPAccount) (*saml2aws.AWSRole, error) {
-	var role = new(saml2aws.AWSRole)
-
-	if len(awsRoles) == 1 {
-		if account.RoleARN != "" {
-			return saml2aws.LocateRole(awsRoles, account.RoleARN)
-		}
-		return awsRoles[0], nil
-	} else if len(awsRoles) == 0 {
-		return nil, errors.New("No roles available.")
-	}
-
+// parseAWSAccounts fetches the accounts the roles belong to from the assertion destination
+// and assigns the principals of the roles to them
+func parseAWSAccounts(samlAssertion string, awsRoles []*saml2aws.AWSRole, httpClient *http.Client) ([]*saml2aws.AWSAccount, error) {
 	samlAssertionData, err := b64.StdEncoding.DecodeString(samlAssertion)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error decoding SAML assertion.")
@@ -109,7 +814,11 @@ func resolveRoleALIAWS(awsRoles []*saml2aws.AWSRole, samlAssertion string, accou
 		return nil, errors.Wrap(err, "Error parsing destination URL.")
 	}
 
-	awsAccounts, err := saml2aws.ParseAWSAccounts(aud, samlAssertion)
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	awsAccounts, err := saml2aws.ParseAWSAccountsWithClient(httpClient, aud, samlAssertion)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error parsing AWS role accounts.")
 	}
@@ -119,47 +828,263 @@ func resolveRoleALIAWS(awsRoles []*saml2aws.AWSRole, samlAssertion string, accou
 
 	saml2aws.AssignPrincipals(awsRoles, awsAccounts)
 
+	return awsAccounts, nil
+}
+
+func resolveRoleALIAWS(awsRoles []*saml2aws.AWSRole, samlAssertion string, account *awscfg.IDPAccount, opts *AWSLoginOptions) (*saml2aws.AWSRole, error) {
+	var role = new(saml2aws.AWSRole)
+
+	var roleFilter func(*saml2aws.AWSRole) bool
+	if opts.AllowedRoleARNsFile != "" {
+		allowed, err := loadRoleAllowlist(opts.AllowedRoleARNsFile)
+		if err != nil {
+			return nil, err
+		}
+		roleFilter = allowed
+
+		awsRoles = saml2aws.FilterRoles(awsRoles, roleFilter)
+		if len(awsRoles) == 0 {
+			return nil, errors.Errorf("None of the available roles are allowed by the role allowlist %s.", opts.AllowedRoleARNsFile)
+		}
+	}
+	if opts.RoleFilter != "" {
+		re, err := regexp.Compile(opts.RoleFilter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid role filter %q.", opts.RoleFilter)
+		}
+		matches := func(awsRole *saml2aws.AWSRole) bool {
+			return re.MatchString(awsRole.RoleARN)
+		}
+
+		awsRoles = saml2aws.FilterRoles(awsRoles, matches)
+		if len(awsRoles) == 0 {
+			return nil, errors.Errorf("No roles match the role filter %q.", opts.RoleFilter)
+		}
+
+		if allowed := roleFilter; allowed != nil {
+			roleFilter = func(awsRole *saml2aws.AWSRole) bool {
+				return allowed(awsRole) && matches(awsRole)
+			}
+		} else {
+			roleFilter = matches
+		}
+	}
+
+	if len(awsRoles) == 1 {
+		if account.RoleARN != "" {
+			role, err := saml2aws.LocateRole(awsRoles, account.RoleARN)
+			if err != nil {
+				return nil, errors.Wrapf(err, "The only role available is %s, update role_arn to assume it.", awsRoles[0].RoleARN)
+			}
+			return role, nil
+		}
+		if opts.RoleIndex != 0 {
+			return saml2aws.LocateRoleByIndex(awsRoles, opts.RoleIndex)
+		}
+		return awsRoles[0], nil
+	} else if len(awsRoles) == 0 {
+		return nil, ErrNoRolesAvailable
+	}
+
+	if opts.AutoSelectFirst && account.RoleARN == "" && opts.RoleIndex == 0 && opts.RoleFilter == "" {
+		role = awsRoles[0]
+		for _, awsRole := range awsRoles[1:] {
+			if awsRole.RoleARN < role.RoleARN {
+				role = awsRole
+			}
+		}
+		logger.WithField("role", role.RoleARN).Info("Auto-selected the first AWS role.")
+		return role, nil
+	}
+
+	awsAccounts, err := parseAWSAccounts(samlAssertion, awsRoles, opts.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+
+	if roleFilter != nil {
+		awsAccounts = saml2aws.FilterAccounts(awsAccounts, roleFilter)
+		if len(awsAccounts) == 0 {
+			return nil, errors.New("No accounts have roles left once filtered.")
+		}
+	}
+
+	// same order as ListRolesAWS, so the prompt is predictable and RoleIndex matches the listing
+	saml2aws.SortAccounts(awsAccounts)
+
 	if account.RoleARN != "" {
 		return saml2aws.LocateRole(awsRoles, account.RoleARN)
 	}
-	role = awsAccounts[0].Roles[0]
+	if opts.RoleIndex != 0 {
+		return saml2aws.LocateRoleByIndex(saml2aws.AccountRoles(awsAccounts), opts.RoleIndex)
+	}
+	if opts.RoleSelector != nil {
+		role, err = opts.RoleSelector(awsAccounts)
+		if err != nil {
+			return nil, errors.Wrap(err, "Role selector failed.")
+		}
+		if role == nil {
+			return nil, errors.New("Role selector returned no role.")
+		}
+		return role, nil
+	}
+
+	if !opts.Reselect {
+		if role := rememberedRoleAWS(account, awsAccounts); role != nil {
+			logger.WithField("role", role.RoleARN).Info("Selected the AWS role picked last time, reselect to change it.")
+			return role, nil
+		}
+	}
+
+	if opts.nonInteractive() {
+		return nil, ErrRoleSelectionRequired
+	}
+
+	return promptAndRememberRoleAWS(account, awsAccounts, opts)
+}
+
+// promptAndRememberRoleAWS prompts for the role and remembers the pick, so the next login of the account selects
+// it without prompting
+func promptAndRememberRoleAWS(account *awscfg.IDPAccount, awsAccounts []*saml2aws.AWSAccount, opts *AWSLoginOptions) (*saml2aws.AWSRole, error) {
+	role, err := promptForRoleAWS(awsAccounts, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveRoleSelection(account, role.RoleARN); err != nil {
+		logger.WithError(err).Warn("Unable to remember the role selection.")
+	}
+
+	return role, nil
+}
+
+// promptForRoleAWS prompts for the role until a valid choice is made, giving up after RolePromptAttempts and
+// right away once the prompt can no longer be answered
+func promptForRoleAWS(awsAccounts []*saml2aws.AWSAccount, opts *AWSLoginOptions) (*saml2aws.AWSRole, error) {
+	attempts := opts.RolePromptAttempts
+	if attempts == 0 {
+		attempts = DefaultRolePromptAttempts
+	}
+
+	var role *saml2aws.AWSRole
+	err := retry.Do(
+		func() error {
+			var err error
+			role, err = promptInterruptibly(func() (*saml2aws.AWSRole, error) {
+				if opts.FuzzyRolePrompt {
+					return saml2aws.PromptForAWSRoleSelectionFuzzy(awsAccounts)
+				}
+				return saml2aws.PromptForAWSRoleSelection(awsAccounts)
+			})
+			return err
+		},
+		retry.Attempts(attempts),
+		retry.Delay(rolePromptRetryDelay),
+		retry.MaxJitter(rolePromptRetryDelay),
+		retry.DelayType(retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)),
+		retry.LastErrorOnly(true),
+		retry.RetryIf(func(err error) bool {
+			return !isPromptClosedError(err)
+		}),
+		retry.OnRetry(
+			func(n uint, err error) {
+				logger.WithError(err).Warn("Error selecting role, try again.")
+			}),
+	)
+	if isPromptClosedError(err) {
+		return nil, errors.Wrap(ErrRoleSelectionAborted, err.Error())
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Role selection failed too many times.")
+	}
+
 	return role, nil
 }
 
-func loginToStsUsingRoleALIAWS(account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string) (*awsconfig.AWSCredentials, error) {
+// isPromptClosedError the prompt returns the same error however often it is asked again
+func isPromptClosedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, terminal.InterruptErr)
+}
+
+func loginToStsUsingRoleALIAWS(ctx context.Context, account *awscfg.IDPAccount, role *saml2aws.AWSRole, samlAssertion string, opts *AWSLoginOptions) (*awsconfig.AWSCredentials, error) {
 
-	sess, err := session.NewSession(&aws.Config{
-		Region: &account.Region,
-	})
+	region, err := resolveRegion(account.Region)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create session.")
+		return nil, err
 	}
 
-	svc := awssts.New(sess)
+	duration, err := resolveSessionDuration(account, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := opts.STSClient
+	if svc == nil {
+		sess, err := session.NewSession(&aws.Config{
+			Region:     aws.String(region),
+			Endpoint:   aws.String(resolveSTSEndpoint(region, opts)),
+			HTTPClient: opts.HTTPClient,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create session.")
+		}
+
+		svc = awssts.New(sess)
+	}
 
 	params := &awssts.AssumeRoleWithSAMLInput{
 		PrincipalArn:    aws.String(role.PrincipalARN), // Required
 		RoleArn:         aws.String(role.RoleARN),      // Required
 		SAMLAssertion:   aws.String(samlAssertion),     // Required
-		DurationSeconds: aws.Int64(int64(account.SessionDuration)),
+		DurationSeconds: aws.Int64(duration),
+	}
+	if opts.SessionPolicy != "" {
+		params.Policy = aws.String(opts.SessionPolicy)
+	}
+	for _, policyARN := range opts.SessionPolicyARNs {
+		params.PolicyArns = append(params.PolicyArns, &awssts.PolicyDescriptorType{Arn: aws.String(policyARN)})
 	}
 
-	log.Println("Requesting AWS credentials using SAML assertion.")
+	logger.Info("Requesting AWS credentials using SAML assertion.")
 
-	resp, err := svc.AssumeRoleWithSAML(params)
+	var resp *awssts.AssumeRoleWithSAMLOutput
+	assumeRole := func() error {
+		var err error
+		resp, err = svc.AssumeRoleWithSAMLWithContext(ctx, params, recordSTSResponse(ctx))
+		// the SDK may echo the request, assertion included, in its error
+		return redact.Error(err, samlAssertion)
+	}
+
+	err = doWithSTSRetry(ctx, opts, assumeRole)
+	if isSessionDurationTooLongError(err) {
+		requested := aws.Int64Value(params.DurationSeconds)
+		if requested <= minMaxSessionDuration {
+			return nil, sessionDurationTooLongError(role.RoleARN, requested)
+		}
+
+		warnSessionDurationClamped(role.RoleARN, requested)
+		params.DurationSeconds = aws.Int64(minMaxSessionDuration)
+
+		err = doWithSTSRetry(ctx, opts, assumeRole)
+		if isSessionDurationTooLongError(err) {
+			return nil, sessionDurationTooLongError(role.RoleARN, requested)
+		}
+	}
+	if isAssertionExpiredError(err) {
+		return nil, errors.Wrap(ErrAssertionExpired, err.Error())
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "Error retrieving STS credentials using SAML.")
 	}
 
-	return &awsconfig.AWSCredentials{
-		AWSAccessKey:     aws.StringValue(resp.Credentials.AccessKeyId),
-		AWSSecretKey:     aws.StringValue(resp.Credentials.SecretAccessKey),
-		AWSSessionToken:  aws.StringValue(resp.Credentials.SessionToken),
-		AWSSecurityToken: aws.StringValue(resp.Credentials.SessionToken),
-		PrincipalARN:     aws.StringValue(resp.AssumedRoleUser.Arn),
-		Expires:          resp.Credentials.Expiration.Local(),
-		Region:           account.Region,
-	}, nil
+	if err := checkSTSCredentials(credentialFields(resp.Credentials, resp.AssumedRoleUser)); err != nil {
+		return nil, err
+	}
+
+	warnIfSessionCapped(role.RoleARN, aws.Int64Value(params.DurationSeconds), aws.TimeValue(resp.Credentials.Expiration), opts.now())
+	observePackedPolicySize(ctx, role.RoleARN, aws.Int64Value(resp.PackedPolicySize))
+
+	return stsCredentials(resp.Credentials, resp.AssumedRoleUser, region, opts), nil
 }
 
 ////////// AWS END
@@ -172,7 +1097,7 @@ func LoginALI(account *alicfg.IDPAccount, loginDetails *alicreds.LoginDetails) (
 		return nil, errors.Wrap(err, "error building IdP client")
 	}
 
-	log.Printf("Authenticating as %s ...", loginDetails.Username)
+	logger.Infof("Authenticating as %s ...", loginDetails.Username)
 
 	samlAssertion, err := provider.Authenticate(loginDetails)
 	if err != nil {
@@ -185,7 +1110,7 @@ func LoginALI(account *alicfg.IDPAccount, loginDetails *alicreds.LoginDetails) (
 		return nil, errors.Wrap(err, "Failed to assume role, please check whether you are permitted to assume the given role for the AlibabaCloud STS service")
 	}
 
-	log.Println("Selected role:", role.RoleARN)
+	logger.WithField("role", role.RoleARN).Info("Selected role")
 
 	alibabacloudCreds, err := loginToStsUsingRoleALI(account, role, samlAssertion)
 	if err != nil {
@@ -207,9 +1132,7 @@ func selectRamRoleALI(samlAssertion string, account *alicfg.IDPAccount) (*saml2a
 	}
 
 	if len(roles) == 0 {
-		log.Println("No roles to assume")
-		log.Println("Please check you are permitted to assume roles for the AlibabaCloud service")
-		os.Exit(1)
+		return nil, ErrNoRolesAvailable
 	}
 
 	alibabacloudRoles, err := saml2alibabacloud.ParseRamRoles(roles)
@@ -229,7 +1152,7 @@ func resolveRoleALI(alibabacloudRoles []*saml2alibabacloud.RamRole, samlAssertio
 		}
 		return alibabacloudRoles[0], nil
 	} else if len(alibabacloudRoles) == 0 {
-		return nil, errors.New("no roles available")
+		return nil, ErrNoRolesAvailable
 	}
 
 	samlAssertionData, err := b64.StdEncoding.DecodeString(samlAssertion)
@@ -275,7 +1198,7 @@ func loginToStsUsingRoleALI(account *alicfg.IDPAccount, role *saml2alibabacloud.
 	request.SAMLAssertion = samlAssertion
 	request.SAMLProviderArn = role.PrincipalARN
 
-	log.Println("Requesting AlibabaCloud credentials using SAML assertion")
+	logger.Info("Requesting AlibabaCloud credentials using SAML assertion")
 
 	response, err := client.AssumeRoleWithSAML(request)
 	if err != nil {
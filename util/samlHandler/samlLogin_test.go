@@ -0,0 +1,618 @@
+package samllogin
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	saml2aws "gocloak/util/samlHandler/aws/pkg"
+	"gocloak/util/samlHandler/aws/pkg/awsconfig"
+	awscfg "gocloak/util/samlHandler/aws/pkg/cfg"
+	awscreds "gocloak/util/samlHandler/aws/pkg/creds"
+	"gocloak/util/samlHandler/aws/pkg/prompter"
+	"gocloak/util/samlHandler/redact"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testPrincipalARN = "arn:aws:iam::123456789012:saml-provider/keycloak"
+	testAdminRoleARN = "arn:aws:iam::123456789012:role/Admin"
+	testReadRoleARN  = "arn:aws:iam::210987654321:role/ReadOnly"
+	testIssuer       = "https://idp.example.com/realms/test"
+)
+
+// fakeSAMLProvider hands out a canned assertion
+type fakeSAMLProvider struct {
+	assertion string
+	err       error
+}
+
+func (f *fakeSAMLProvider) Authenticate(loginDetails *awscreds.LoginDetails) (string, error) {
+	return f.assertion, f.err
+}
+
+func (f *fakeSAMLProvider) Validate(loginDetails *awscreds.LoginDetails) error {
+	return nil
+}
+
+// roleAttribute the Role attribute values granting the roles, nil omits the attribute
+func roleAttribute(roleARNs ...string) []string {
+	values := []string{}
+	for _, roleARN := range roleARNs {
+		values = append(values, roleARN+","+testPrincipalARN)
+	}
+
+	return values
+}
+
+// buildAssertion a base64 encoded SAML response for destination, granting the roles of the Role attribute values
+func buildAssertion(destination string, roleValues []string) string {
+	var attribute string
+	if roleValues != nil {
+		var values strings.Builder
+		for _, value := range roleValues {
+			fmt.Fprintf(&values, "<saml:AttributeValue>%s</saml:AttributeValue>", value)
+		}
+		attribute = fmt.Sprintf(`<saml:Attribute Name="https://aws.amazon.com/SAML/Attributes/Role">%s</saml:Attribute>`, values.String())
+	}
+
+	notOnOrAfter := time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339)
+
+	response := fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Destination="%s">
+  <saml:Issuer>%s</saml:Issuer>
+  <saml:Assertion>
+    <saml:Subject>
+      <saml:SubjectConfirmation>
+        <saml:SubjectConfirmationData NotOnOrAfter="%s" Recipient="%s"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:AttributeStatement>%s</saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`, destination, testIssuer, notOnOrAfter, destination, attribute)
+
+	return b64.StdEncoding.EncodeToString([]byte(response))
+}
+
+// newAWSSigninServer serves the AWS role selection page listing the roles of two accounts
+func newAWSSigninServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body><form><fieldset>
+<div class="saml-account"><div class="saml-account-name">Account: staging (210987654321)</div><label for="%s">ReadOnly</label></div>
+<div class="saml-account"><div class="saml-account-name">Account: prod (123456789012)</div><label for="%s">Admin</label></div>
+</fieldset></form></body></html>`, testReadRoleARN, testAdminRoleARN)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newTestIDPAccount() *awscfg.IDPAccount {
+	return &awscfg.IDPAccount{
+		Name:            "test",
+		URL:             "https://idp.example.com",
+		Username:        "alice",
+		Provider:        "KeyCloak",
+		MFA:             "Auto",
+		Profile:         "saml",
+		Region:          "us-east-1",
+		SessionDuration: 3600,
+	}
+}
+
+// captureLogs records what the package logs during the test, after the redaction
+func captureLogs(t *testing.T) *logrustest.Hook {
+	hooks := baseLogger.ReplaceHooks(make(logrus.LevelHooks))
+	t.Cleanup(func() { baseLogger.ReplaceHooks(hooks) })
+	baseLogger.AddHook(redact.Hook{})
+
+	hook := new(logrustest.Hook)
+	baseLogger.AddHook(hook)
+	return hook
+}
+
+// useTempHome keeps the credentials cache of the test away from the real one
+func useTempHome(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", "")
+	t.Setenv(EnvCacheDir, "")
+	homedir.Reset()
+	t.Cleanup(homedir.Reset)
+}
+
+func TestLoginAWSWithResultSingleRole(t *testing.T) {
+	useTempHome(t)
+
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	fake := &fakeSTS{}
+	opts := &AWSLoginOptions{
+		NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			return &fakeSAMLProvider{assertion: assertion}, nil
+		},
+		STSClient: fake,
+	}
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	result, err := LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+	require.Nil(t, err)
+
+	assert.Equal(t, testAdminRoleARN, result.Role.RoleARN)
+	assert.Equal(t, testPrincipalARN, result.Role.PrincipalARN)
+	assert.Equal(t, assertion, result.Assertion)
+	assert.Equal(t, "ASIAEXAMPLE", result.Credentials.AWSAccessKey)
+	assert.Equal(t, "user@example.com", result.RoleSessionName)
+	assert.NotNil(t, result.STSResponse)
+	require.Equal(t, 1, fake.calls)
+	assert.Equal(t, assertion, *fake.inputs[0].SAMLAssertion)
+}
+
+func TestLoginAWSWithResultWriteCredentialsFile(t *testing.T) {
+	useTempHome(t)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	opts := &AWSLoginOptions{
+		NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			return &fakeSAMLProvider{assertion: assertion}, nil
+		},
+		STSClient: &fakeSTS{},
+		NoCache:   true,
+	}
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	_, err := LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+	require.Nil(t, err)
+	assert.NoFileExists(t, credentialsFile, "the credentials file is only written on request")
+
+	opts.WriteCredentialsFile = true
+	_, err = LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+	require.Nil(t, err)
+
+	saved, err := awsconfig.NewSharedCredentials("saml", credentialsFile).Load()
+	require.Nil(t, err)
+	assert.Equal(t, "ASIAEXAMPLE", saved.AWSAccessKey)
+}
+
+func TestLoginAWSWithResultAuthenticationFailure(t *testing.T) {
+	useTempHome(t)
+
+	opts := &AWSLoginOptions{
+		NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			return &fakeSAMLProvider{err: errors.New("invalid credentials")}, nil
+		},
+		STSClient: &fakeSTS{},
+	}
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "wrong"}
+
+	_, err := LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+	require.NotNil(t, err)
+
+	assert.True(t, errors.Is(err, ErrAuthenticate))
+	assert.Contains(t, err.Error(), "invalid credentials")
+}
+
+func TestSelectRoleAWSSingleRole(t *testing.T) {
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+
+	role, err := selectRoleAWS(assertion, newTestIDPAccount(), &AWSLoginOptions{})
+	require.Nil(t, err)
+
+	assert.Equal(t, testAdminRoleARN, role.RoleARN)
+	assert.Equal(t, testPrincipalARN, role.PrincipalARN)
+}
+
+func TestSelectRoleAWSSingleRoleNotConfigured(t *testing.T) {
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	account := newTestIDPAccount()
+	account.RoleARN = testReadRoleARN
+
+	_, err := selectRoleAWS(assertion, account, &AWSLoginOptions{})
+	require.NotNil(t, err)
+
+	assert.Contains(t, err.Error(), "The only role available is "+testAdminRoleARN)
+	assert.Contains(t, err.Error(), testReadRoleARN)
+}
+
+func TestSelectRoleAWSNoRoleAttribute(t *testing.T) {
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", nil)
+
+	_, err := selectRoleAWS(assertion, newTestIDPAccount(), &AWSLoginOptions{})
+	require.NotNil(t, err)
+
+	assert.True(t, errors.Is(err, ErrNoRoleAttribute))
+	assert.True(t, errors.Is(err, ErrNoRolesAvailable))
+	assert.Contains(t, err.Error(), testIssuer)
+}
+
+func TestSelectRoleAWSEmptyRoleAttribute(t *testing.T) {
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", []string{""})
+
+	_, err := selectRoleAWS(assertion, newTestIDPAccount(), &AWSLoginOptions{})
+	require.NotNil(t, err)
+
+	assert.True(t, errors.Is(err, ErrEmptyRoleAttribute))
+	assert.True(t, errors.Is(err, ErrNoRolesAvailable))
+}
+
+func TestResolveRoleMultiRole(t *testing.T) {
+	useTempHome(t)
+	server := newAWSSigninServer(t)
+	assertion := buildAssertion(server.URL, roleAttribute(testAdminRoleARN, testReadRoleARN))
+
+	awsRoles, err := extractAWSRoles(assertion)
+	require.Nil(t, err)
+	require.Len(t, awsRoles, 2)
+
+	t.Run("configured role ARN", func(t *testing.T) {
+		account := newTestIDPAccount()
+		account.RoleARN = testReadRoleARN
+
+		role, err := resolveRoleALIAWS(awsRoles, assertion, account, &AWSLoginOptions{})
+		require.Nil(t, err)
+		assert.Equal(t, testReadRoleARN, role.RoleARN)
+	})
+
+	t.Run("role index follows the sorted accounts", func(t *testing.T) {
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{RoleIndex: 1})
+		require.Nil(t, err)
+		assert.Equal(t, testAdminRoleARN, role.RoleARN)
+		assert.Equal(t, testPrincipalARN, role.PrincipalARN)
+	})
+
+	t.Run("role filter", func(t *testing.T) {
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{RoleFilter: "ReadOnly$"})
+		require.Nil(t, err)
+		assert.Equal(t, testReadRoleARN, role.RoleARN)
+	})
+
+	t.Run("role selector", func(t *testing.T) {
+		var offered []*saml2aws.AWSAccount
+		opts := &AWSLoginOptions{
+			RoleSelector: func(accounts []*saml2aws.AWSAccount) (*saml2aws.AWSRole, error) {
+				offered = accounts
+				return accounts[1].Roles[0], nil
+			},
+		}
+
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), opts)
+		require.Nil(t, err)
+		assert.Equal(t, testReadRoleARN, role.RoleARN)
+		require.Len(t, offered, 2)
+		assert.Equal(t, "Account: prod (123456789012)", offered[0].Name)
+	})
+
+	t.Run("role allowlist", func(t *testing.T) {
+		allowlist := filepath.Join(t.TempDir(), "allowed-roles")
+		require.Nil(t, os.WriteFile(allowlist, []byte("# read only everywhere\narn:aws:iam::*:role/ReadOnly\n\n"), 0600))
+
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{AllowedRoleARNsFile: allowlist, NonInteractive: true})
+		require.Nil(t, err)
+		assert.Equal(t, testReadRoleARN, role.RoleARN)
+
+		account := newTestIDPAccount()
+		account.RoleARN = testAdminRoleARN
+		_, err = resolveRoleALIAWS(awsRoles, assertion, account, &AWSLoginOptions{AllowedRoleARNsFile: allowlist})
+		assert.NotNil(t, err, "a configured role missing from the allowlist is refused")
+	})
+
+	t.Run("role allowlist without any available role", func(t *testing.T) {
+		allowlist := filepath.Join(t.TempDir(), "allowed-roles")
+		require.Nil(t, os.WriteFile(allowlist, []byte("arn:aws:iam::999999999999:role/*\n"), 0600))
+
+		_, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{AllowedRoleARNsFile: allowlist})
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), "role allowlist")
+	})
+
+	t.Run("auto-select first by ARN", func(t *testing.T) {
+		role, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{AutoSelectFirst: true, NonInteractive: true})
+		require.Nil(t, err)
+		assert.Equal(t, testAdminRoleARN, role.RoleARN)
+	})
+
+	t.Run("non-interactive without a selection", func(t *testing.T) {
+		_, err := resolveRoleALIAWS(awsRoles, assertion, newTestIDPAccount(), &AWSLoginOptions{NonInteractive: true})
+		assert.Equal(t, ErrRoleSelectionRequired, err)
+	})
+}
+
+func TestLoadIDPAccountAWS(t *testing.T) {
+	useTempHome(t)
+
+	config := "[prod]\nurl = https://idp.example.com\nusername = alice\nprovider = KeyCloak\nmfa = Auto\n\n[staging]\nurl = https://idp.staging.example.com\n"
+	require.Nil(t, os.WriteFile(filepath.Join(os.Getenv("HOME"), ".saml2aws"), []byte(config), 0600))
+
+	account, err := loadIDPAccountAWS("", "prod")
+	require.Nil(t, err)
+	assert.Equal(t, "prod", account.Name)
+	assert.Equal(t, "https://idp.example.com", account.URL)
+
+	_, err = loadIDPAccountAWS("", "dev")
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, awscfg.ErrIdpAccountNotFound))
+	assert.Contains(t, err.Error(), "[prod, staging]")
+
+	configPath := filepath.Join(t.TempDir(), "project.saml2aws")
+	require.Nil(t, os.WriteFile(configPath, []byte("[dev]\nurl = https://idp.dev.example.com\n"), 0600))
+
+	account, err = loadIDPAccountAWS(configPath, "dev")
+	require.Nil(t, err)
+	assert.Equal(t, "https://idp.dev.example.com", account.URL)
+}
+
+// fakePrompter answers the role prompt with the queued errors, then with the first option
+type fakePrompter struct {
+	prompter.Prompter
+	errs  []error
+	calls int
+}
+
+func (f *fakePrompter) ChooseWithDefault(pr string, defaultValue string, options []string) (string, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return "", err
+	}
+
+	return options[0], nil
+}
+
+// fuzzyPrompter answers the fuzzy role prompt with the first option
+type fuzzyPrompter struct {
+	fakePrompter
+	fuzzy bool
+}
+
+func (f *fuzzyPrompter) ChooseFuzzy(pr string, defaultValue string, options []string) (string, error) {
+	f.fuzzy = true
+	return options[0], nil
+}
+
+func usePrompter(t *testing.T, p prompter.Prompter) {
+	previous := prompter.ActivePrompter
+	prompter.SetPrompter(p)
+	t.Cleanup(func() { prompter.SetPrompter(previous) })
+}
+
+func TestPromptForRoleAWS(t *testing.T) {
+	accounts := []*saml2aws.AWSAccount{
+		{Name: "Account: prod (123456789012)", Roles: []*saml2aws.AWSRole{{RoleARN: testAdminRoleARN, Name: "Admin"}}},
+	}
+
+	t.Run("retries an invalid answer", func(t *testing.T) {
+		fake := &fakePrompter{errs: []error{errors.New("invalid choice")}}
+		usePrompter(t, fake)
+
+		role, err := promptForRoleAWS(accounts, &AWSLoginOptions{})
+		require.Nil(t, err)
+		assert.Equal(t, testAdminRoleARN, role.RoleARN)
+		assert.Equal(t, 2, fake.calls)
+	})
+
+	t.Run("gives up after the attempts", func(t *testing.T) {
+		fake := &fakePrompter{errs: []error{errors.New("invalid choice"), errors.New("invalid choice")}}
+		usePrompter(t, fake)
+
+		_, err := promptForRoleAWS(accounts, &AWSLoginOptions{RolePromptAttempts: 2})
+		require.NotNil(t, err)
+		assert.Equal(t, 2, fake.calls)
+	})
+
+	t.Run("fuzzy prompt", func(t *testing.T) {
+		fake := &fuzzyPrompter{}
+		usePrompter(t, fake)
+
+		role, err := promptForRoleAWS(accounts, &AWSLoginOptions{FuzzyRolePrompt: true})
+		require.Nil(t, err)
+		assert.Equal(t, testAdminRoleARN, role.RoleARN)
+		assert.True(t, fake.fuzzy)
+		assert.Equal(t, 0, fake.calls)
+	})
+
+	t.Run("aborts on EOF", func(t *testing.T) {
+		fake := &fakePrompter{errs: []error{io.EOF}}
+		usePrompter(t, fake)
+
+		_, err := promptForRoleAWS(accounts, &AWSLoginOptions{})
+		assert.True(t, errors.Is(err, ErrRoleSelectionAborted))
+		assert.Equal(t, 1, fake.calls)
+	})
+}
+
+// hangingSAMLProvider never answers until released, like a hung IdP
+type hangingSAMLProvider struct {
+	fakeSAMLProvider
+	release chan struct{}
+}
+
+func (h *hangingSAMLProvider) Authenticate(loginDetails *awscreds.LoginDetails) (string, error) {
+	<-h.release
+	return "", errors.New("released")
+}
+
+func TestLoginAWSWithResultAuthenticateTimeout(t *testing.T) {
+	useTempHome(t)
+
+	provider := &hangingSAMLProvider{release: make(chan struct{})}
+	t.Cleanup(func() { close(provider.release) })
+
+	opts := &AWSLoginOptions{
+		NewSAMLProvider: func(account *awscfg.IDPAccount) (saml2aws.SAMLClient, error) {
+			return provider, nil
+		},
+		STSClient:           &fakeSTS{},
+		AuthenticateTimeout: 10 * time.Millisecond,
+	}
+	loginDetails := &awscreds.LoginDetails{URL: "https://idp.example.com", Username: "alice", Password: "secret"}
+
+	_, err := LoginAWSWithResult(context.Background(), newTestIDPAccount(), loginDetails, opts)
+	require.NotNil(t, err)
+
+	assert.True(t, errors.Is(err, ErrAuthenticate))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestSummarizeAccounts(t *testing.T) {
+	accounts := []*saml2aws.AWSAccount{
+		{Name: "Account: prod (123456789012)", Roles: []*saml2aws.AWSRole{{RoleARN: testAdminRoleARN}}},
+		{Name: "Account: prod (123456789012)", Roles: []*saml2aws.AWSRole{{RoleARN: "arn:aws:iam::123456789012:role/Audit"}}},
+		{Name: "staging", Roles: []*saml2aws.AWSRole{{RoleARN: testReadRoleARN}}},
+	}
+
+	assert.Equal(t, []AccountSummary{
+		{ID: "123456789012", Alias: "prod"},
+		{ID: "210987654321", Alias: "staging"},
+	}, summarizeAccounts(accounts))
+}
+
+func TestLoginAWSWithAssertionSkipsIdPAndCache(t *testing.T) {
+	useTempHome(t)
+
+	// a captured assertion, wrapped like it was pasted from a file
+	assertion := buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN))
+	wrapped := assertion[:20] + "\n" + assertion[20:] + "\n"
+
+	fake := &fakeSTS{}
+	account := newTestIDPAccount()
+	account.RoleARN = testAdminRoleARN
+
+	awsCreds, err := LoginAWSWithAssertionAndOptions(context.Background(), account, wrapped, &AWSLoginOptions{STSClient: fake})
+	require.Nil(t, err)
+	assert.Equal(t, "ASIAEXAMPLE", awsCreds.AWSAccessKey)
+	require.Equal(t, 1, fake.calls)
+	assert.Equal(t, assertion, *fake.inputs[0].SAMLAssertion)
+
+	cachePath, err := credentialsCachePath(account, account.RoleARN, &AWSLoginOptions{})
+	require.Nil(t, err)
+	assert.NoFileExists(t, cachePath)
+}
+
+func TestDescribeValidity(t *testing.T) {
+	now := time.Date(2024, 1, 1, 15, 4, 0, 0, time.UTC)
+
+	assert.Equal(t, "credentials valid for 11h59m until 2024-01-02 03:03 UTC",
+		describeValidity(&awsconfig.AWSCredentials{Expires: now.Add(11*time.Hour + 59*time.Minute + 10*time.Second)}, now))
+	assert.Equal(t, "credentials valid for 42m until 2024-01-01 15:46 UTC",
+		describeValidity(&awsconfig.AWSCredentials{Expires: now.Add(42*time.Minute + 10*time.Second)}, now))
+	assert.Equal(t, "credentials valid for 12h00m until 2024-01-02 03:04 UTC", describeValidity(testCreds, now))
+
+	assert.Equal(t, "credentials expired at 2024-01-02 03:04 UTC", describeValidity(testCreds, time.Now()))
+}
+
+func TestRolesToJSON(t *testing.T) {
+	accounts := []*saml2aws.AWSAccount{
+		{Name: "Account: prod (123456789012)", Roles: []*saml2aws.AWSRole{{RoleARN: testAdminRoleARN, PrincipalARN: testPrincipalARN}}},
+		{Name: "Account: staging (210987654321)", Roles: []*saml2aws.AWSRole{{RoleARN: testReadRoleARN, PrincipalARN: testPrincipalARN}}},
+	}
+
+	out, err := rolesToJSON(accounts)
+	require.Nil(t, err)
+
+	var parsed []map[string]string
+	require.Nil(t, json.Unmarshal([]byte(out), &parsed))
+	assert.Equal(t, []map[string]string{
+		{"account": "123456789012", "accountAlias": "prod", "roleArn": testAdminRoleARN, "principalArn": testPrincipalARN},
+		{"account": "210987654321", "accountAlias": "staging", "roleArn": testReadRoleARN, "principalArn": testPrincipalARN},
+	}, parsed)
+}
+
+func TestLoggerRedactsOnlyItsOwnEntries(t *testing.T) {
+	hook := captureLogs(t)
+	standard := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	logger.WithField("password", "hunter2").Info("login")
+	logrus.WithField("password", "hunter2").Info("host")
+
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, redact.Placeholder, hook.LastEntry().Data["password"])
+	require.Len(t, standard.AllEntries(), 1)
+	assert.Equal(t, "hunter2", standard.LastEntry().Data["password"], "the logs of the host application are left alone")
+}
+
+func TestLogAssertionOrigin(t *testing.T) {
+	hook := captureLogs(t)
+
+	logAssertionOrigin(buildAssertion("https://signin.aws.amazon.com/saml", roleAttribute(testAdminRoleARN)))
+
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.InfoLevel, hook.LastEntry().Level)
+	assert.Equal(t, testIssuer, hook.LastEntry().Data["issuer"])
+	assert.Equal(t, "https://signin.aws.amazon.com/saml", hook.LastEntry().Data["destination"])
+}
+
+func TestAwaitPromptInterrupted(t *testing.T) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+
+	interrupts := make(chan os.Signal, 1)
+	interrupts <- os.Interrupt
+
+	_, err := awaitPrompt(func() (*saml2aws.AWSRole, error) {
+		<-release
+		return nil, nil
+	}, interrupts)
+	assert.True(t, isPromptClosedError(err))
+}
+
+// newKeycloakServer serves a Keycloak login form, answering the login with the page
+func newKeycloakServer(t *testing.T, page string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			fmt.Fprint(w, page)
+			return
+		}
+		fmt.Fprintf(w, `<html><body><form id="kc-form-login" action="%s/login" method="post">
+<input name="username"/><input name="password" type="password"/></form></body></html>`, server.URL)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAuthenticateToIdPAWSAccountState(t *testing.T) {
+	useTempHome(t)
+
+	tests := []struct {
+		name    string
+		message string
+		want    error
+	}{
+		{name: "locked", message: "Account is temporarily disabled; contact your administrator or retry later.", want: ErrAccountLocked},
+		{name: "disabled", message: "Account is disabled, contact your administrator.", want: ErrAccountDisabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newKeycloakServer(t, `<html><body><span id="input-error">`+tt.message+`</span></body></html>`)
+
+			account := newTestIDPAccount()
+			account.URL = server.URL
+			loginDetails := &awscreds.LoginDetails{URL: server.URL, Username: "alice", Password: "secret"}
+
+			_, err := authenticateToIdPAWS(context.Background(), account, loginDetails, &AWSLoginOptions{IdPAttempts: 1})
+			require.NotNil(t, err)
+			assert.True(t, errors.Is(err, tt.want))
+			assert.True(t, errors.Is(err, ErrAuthenticate))
+			assert.Contains(t, err.Error(), tt.message)
+			assert.NotContains(t, err.Error(), "Error authenticating to IdP")
+		})
+	}
+}